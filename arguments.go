@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validateCustomInstructions checks the extension keys of the document
+// before any extension runs: required extensions must be used in every map
+// their path leads to, and the arguments given must bind to the extension's
+// arguments. All problems are reported at once, with the extension's usage.
+func validateCustomInstructions(config *XDockerConfig) error {
+	extNames, err := extensionOrder(extensions)
+	if err != nil {
+		return err
+	}
+
+	root := configDocument(config)
+	var problems []string
+	for _, extName := range extNames {
+		ext := extensions[extName]
+		if ext.Path == "" {
+			continue
+		}
+		segments, key, err := parseExtensionPath(ext.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("extension %s: %v", extName, err))
+			continue
+		}
+		for _, target := range findExtensionTargets(root, segments) {
+			where := fmt.Sprintf("%s: %s", config.FileName, describeKeyPath(append(target.path, key)))
+			value, present := target.container[key]
+			if !present {
+				if ext.Required {
+					problems = append(problems, fmt.Sprintf("%s: %s\n%s", where, missingKey(ext, key, target.container), extensionUsage(ext)))
+				}
+				continue
+			}
+			_, err := bindExtensionArguments(ext, value)
+			if argErrs, ok := err.(argumentErrors); ok {
+				for _, argErr := range argErrs {
+					problems = append(problems, fmt.Sprintf("%s: %s", where, argErr))
+				}
+				problems = append(problems, extensionUsage(ext))
+			} else if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v\n%s", where, err, extensionUsage(ext)))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid custom instructions:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// missingKey describes the missing key of a required extension, suggesting
+// a key of container that looks like a typo of it, or else the arguments
+// the key takes.
+func missingKey(ext Extension, key string, container map[string]interface{}) string {
+	keys := make([]string, 0, len(container))
+	for k := range container {
+		keys = append(keys, k)
+	}
+	if suggestion := didYouMean(key, keys); suggestion != "" {
+		return fmt.Sprintf("missing required key %q%s", key, suggestion)
+	}
+	names := make([]string, 0, len(ext.Arguments))
+	for name := range ext.Arguments {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("missing required key %q", key)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("missing required key %q (arguments: %s)", key, strings.Join(names, ", "))
+}
+
+// extensionUsage describes an extension and its arguments for error messages.
+func extensionUsage(ext Extension) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  %s (%s)", ext.Name, ext.Path)
+	if ext.Description != "" {
+		fmt.Fprintf(&b, ": %s", ext.Description)
+	}
+	names := make([]string, 0, len(ext.Arguments))
+	for name := range ext.Arguments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n    %s", argumentUsage(name, ext.Arguments[name]))
+	}
+	return b.String()
+}
+
+// argumentUsage describes a single argument of an extension.
+func argumentUsage(name string, arg Argument) string {
+	typ := arg.Type
+	if typ == "" {
+		typ = "string"
+	}
+	details := []string{typ}
+	if arg.Required {
+		details = append(details, "required")
+	}
+	if arg.Default != nil {
+		details = append(details, "default "+formatExpressionResult(arg.Default))
+	}
+	usage := fmt.Sprintf("%s (%s)", name, strings.Join(details, ", "))
+	if arg.Description != "" {
+		usage += ": " + arg.Description
+	}
+	return usage
+}
+
+// didYouMean suggests the candidate closest to name, if one is close enough
+// to be a likely typo.
+func didYouMean(name string, candidates []string) string {
+	best, bestDistance := "", len(name)/2+1
+	for _, candidate := range candidates {
+		if d := editDistance(name, candidate); d > 0 && d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// argumentErrors are all the problems with the arguments given to an
+// extension.
+type argumentErrors []string
+
+func (e argumentErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// bindExtensionArguments binds the value found under the key of an extension
+// to its arguments. A mapping binds each argument by name; a list or a scalar
+// binds the extension's single argument. Values are checked and converted
+// according to the argument types, missing arguments get their default and
+// required arguments without one are an error. All the problems of the value
+// are returned together, as argumentErrors.
+func bindExtensionArguments(ext Extension, value interface{}) (map[string]interface{}, error) {
+	names := make([]string, 0, len(ext.Arguments))
+	for name := range ext.Arguments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems argumentErrors
+	given := make(map[string]interface{})
+	m, isMap := value.(map[string]interface{})
+	switch {
+	case isMap && !(len(names) == 1 && ext.Arguments[names[0]].Type == "map"):
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if _, ok := ext.Arguments[key]; !ok {
+				problems = append(problems, fmt.Sprintf("unknown argument %q%s (arguments: %s)", key, didYouMean(key, names), strings.Join(names, ", ")))
+				continue
+			}
+			given[key] = m[key]
+		}
+	case len(names) == 1:
+		given[names[0]] = value
+	case len(names) == 0:
+		// extensions without arguments only use the presence of their key
+	default:
+		return nil, fmt.Errorf("expected a mapping of the arguments %s, got %s", strings.Join(names, ", "), formatExpressionResult(value))
+	}
+
+	args := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		arg := ext.Arguments[name]
+		v, ok := given[name]
+		if !ok || v == nil {
+			if arg.Default == nil {
+				if arg.Required {
+					problems = append(problems, fmt.Sprintf("missing required argument %q", name))
+				}
+				args[name] = nil
+				continue
+			}
+			// env arguments fall back to their default in convertArgument
+			if arg.Type != "env" {
+				v = arg.Default
+			}
+		}
+		converted, err := convertArgument(arg, v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("argument %q: %v", name, err))
+			continue
+		}
+		args[name] = converted
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return args, nil
+}
+
+// argumentTypes are the types an extension argument can have.
+var argumentTypes = map[string]bool{
+	"": true, "string": true, "bool": true, "int": true, "float": true,
+	"env": true, "list": true, "map": true,
+}
+
+// convertArgument checks value against the type of arg and converts it.
+// Scalars written as strings are accepted for bool, int and float arguments.
+func convertArgument(arg Argument, value interface{}) (interface{}, error) {
+	switch arg.Type {
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.ToLower(v) {
+			case "true", "yes", "on", "1":
+				return true, nil
+			case "false", "no", "off", "0", "":
+				return false, nil
+			}
+		case int:
+			return v != 0, nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			if v == float64(int(v)) {
+				return int(v), nil
+			}
+		case string:
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				return i, nil
+			}
+		}
+	case "float":
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+	case "env":
+		// The value names an environment variable; the default is the name
+		// of a fallback variable or, when that is not set either, the value
+		// itself
+		if value != nil {
+			if env := os.Getenv(fmt.Sprintf("%v", value)); env != "" {
+				return env, nil
+			}
+		}
+		if arg.Default == nil {
+			return "", nil
+		}
+		def := fmt.Sprintf("%v", arg.Default)
+		if env := os.Getenv(def); env != "" {
+			return env, nil
+		}
+		return def, nil
+	case "list":
+		if v, ok := value.([]interface{}); ok {
+			return v, nil
+		}
+	case "map":
+		if v, ok := value.(map[string]interface{}); ok {
+			return v, nil
+		}
+	case "", "string":
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+		default:
+			return formatExpressionResult(value), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %q", arg.Type)
+	}
+	typ := arg.Type
+	if typ == "" {
+		typ = "string"
+	}
+	return nil, fmt.Errorf("expected %s, got %s", typ, formatExpressionResult(value))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBindExtensionArguments(t *testing.T) {
+	t.Setenv("XDOCKER_TEST_TOKEN", "secret")
+	t.Setenv("XDOCKER_TEST_FALLBACK", "fallback")
+	single := func(arg Argument) map[string]Argument { return map[string]Argument{"value": arg} }
+
+	tests := []struct {
+		name  string
+		args  map[string]Argument
+		value interface{}
+		want  map[string]interface{}
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{name: "string", args: single(Argument{}), value: 8080, want: map[string]interface{}{"value": "8080"}},
+		{name: "string from a list", args: single(Argument{Type: "string"}), value: []interface{}{"a"}, err: `argument "value": expected string, got ["a"]`},
+		{name: "bool", args: single(Argument{Type: "bool"}), value: true, want: map[string]interface{}{"value": true}},
+		{name: "bool from a string", args: single(Argument{Type: "bool"}), value: "Yes", want: map[string]interface{}{"value": true}},
+		{name: "bool from an int", args: single(Argument{Type: "bool"}), value: 0, want: map[string]interface{}{"value": false}},
+		{name: "bad bool", args: single(Argument{Type: "bool"}), value: "maybe", err: `argument "value": expected bool, got maybe`},
+		{name: "int", args: single(Argument{Type: "int"}), value: 3, want: map[string]interface{}{"value": 3}},
+		{name: "int from a string", args: single(Argument{Type: "int"}), value: " 42 ", want: map[string]interface{}{"value": 42}},
+		{name: "int from a whole float", args: single(Argument{Type: "int"}), value: 2.0, want: map[string]interface{}{"value": 2}},
+		{name: "int from a fraction", args: single(Argument{Type: "int"}), value: 2.5, err: `argument "value": expected int, got 2.5`},
+		{name: "float from an int", args: single(Argument{Type: "float"}), value: 2, want: map[string]interface{}{"value": 2.0}},
+		{name: "float from a string", args: single(Argument{Type: "float"}), value: "0.5", want: map[string]interface{}{"value": 0.5}},
+		{name: "env", args: single(Argument{Type: "env"}), value: "XDOCKER_TEST_TOKEN", want: map[string]interface{}{"value": "secret"}},
+		{name: "env falls back to the default variable", args: single(Argument{Type: "env", Default: "XDOCKER_TEST_FALLBACK"}), value: "XDOCKER_TEST_UNSET", want: map[string]interface{}{"value": "fallback"}},
+		{name: "env falls back to the default value", args: single(Argument{Type: "env", Default: "plain"}), value: nil, want: map[string]interface{}{"value": "plain"}},
+		{name: "list", args: single(Argument{Type: "list"}), value: []interface{}{1, "b"}, want: map[string]interface{}{"value": []interface{}{1, "b"}}},
+		{name: "list from a scalar", args: single(Argument{Type: "list"}), value: "a", err: `argument "value": expected list, got a`},
+		{name: "map as the single argument", args: single(Argument{Type: "map"}), value: map[string]interface{}{"a": 1}, want: map[string]interface{}{"value": map[string]interface{}{"a": 1}}},
+		{name: "unsupported type", args: single(Argument{Type: "date"}), value: "today", err: `argument "value": unsupported type "date"`},
+		{
+			name:  "arguments by name with defaults",
+			args:  map[string]Argument{"port": {Type: "int", Default: 80}, "host": {Default: "localhost"}, "tls": {Type: "bool"}},
+			value: map[string]interface{}{"port": "8080"},
+			want:  map[string]interface{}{"port": 8080, "host": "localhost", "tls": nil},
+		},
+		{
+			name:  "scalar for several arguments",
+			args:  map[string]Argument{"port": {Type: "int"}, "host": {}},
+			value: 8080,
+			err:   "expected a mapping of the arguments host, port, got 8080",
+		},
+		{name: "key of an extension without arguments", args: nil, value: true, want: map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := bindExtensionArguments(Extension{Name: "ext", Arguments: test.args}, test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("bindExtensionArguments(%v) error = %v, want one containing %q", test.value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bindExtensionArguments(%v): %v", test.value, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("bindExtensionArguments(%v) = %#v, want %#v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateCustomInstructions(t *testing.T) {
+	proxy := Extension{
+		Name:     "proxy",
+		Path:     "/$service/proxy",
+		Required: true,
+		Arguments: map[string]Argument{
+			"host": {Required: true},
+			"port": {Type: "int", Default: 80},
+		},
+	}
+	usage := "  proxy (/$service/proxy)\n    host (string, required)\n    port (int, default 80)"
+
+	tests := []struct {
+		name    string
+		service map[string]interface{}
+		// err is the expected error without its first line, if any
+		err string
+	}{
+		{name: "valid", service: map[string]interface{}{"proxy": map[string]interface{}{"host": "example.com"}}},
+		{
+			name:    "every problem of a key",
+			service: map[string]interface{}{"proxy": map[string]interface{}{"hots": "example.com", "port": "http"}},
+			err: `xdocker-compose.yml: service "web", key "proxy": unknown argument "hots", did you mean "host"? (arguments: host, port)
+xdocker-compose.yml: service "web", key "proxy": missing required argument "host"
+xdocker-compose.yml: service "web", key "proxy": argument "port": expected int, got http
+` + usage,
+		},
+		{
+			name:    "missing key with a typo",
+			service: map[string]interface{}{"porxy": map[string]interface{}{"host": "example.com"}},
+			err:     `xdocker-compose.yml: service "web", key "proxy": missing required key "proxy", did you mean "porxy"?` + "\n" + usage,
+		},
+		{
+			name:    "missing key",
+			service: map[string]interface{}{"image": "nginx"},
+			err:     `xdocker-compose.yml: service "web", key "proxy": missing required key "proxy" (arguments: host, port)` + "\n" + usage,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loaded := extensions
+			extensions = map[string]Extension{"proxy": proxy}
+			defer func() { extensions = loaded }()
+
+			config := &XDockerConfig{FileName: "xdocker-compose.yml", Services: map[string]interface{}{"web": test.service}}
+			err := validateCustomInstructions(config)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("validateCustomInstructions(): %v", err)
+				}
+				return
+			}
+			want := "invalid custom instructions:\n" + test.err
+			if err == nil || err.Error() != want {
+				t.Errorf("validateCustomInstructions() error =\n%v\nwant\n%s", err, want)
+			}
+		})
+	}
+}
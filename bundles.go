@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// bundleManifestName is the manifest of an extension bundle. It is kept in
+// the directory a bundle is installed to, which marks the directory as one
+// the extensions are loaded from.
+const bundleManifestName = "xdocker-extension.yml"
+
+// projectLockFile records the bundles installed into the project's
+// extensions directory, to be committed with the project.
+const projectLockFile = "xdocker-extensions.lock"
+
+// maxBundleFileSize caps the size of a single file of a bundle.
+const maxBundleFileSize = 10 << 20
+
+// bundleManifest describes an extension bundle.
+type bundleManifest struct {
+	Name        string `yaml:"name"`
+	Version     string `yaml:"version"`
+	Description string `yaml:"description,omitempty"`
+	// Xdocker is the xdocker version the bundle needs, such as `>=1.0`
+	Xdocker string   `yaml:"xdocker,omitempty"`
+	Files   []string `yaml:"files"`
+}
+
+// extensionBundle is a bundle read from a directory or a tarball.
+type extensionBundle struct {
+	manifest     bundleManifest
+	manifestData []byte
+	files        map[string][]byte
+}
+
+// extensionLock is the content of a lockfile: the installed bundles by name.
+type extensionLock struct {
+	Extensions map[string]lockedBundle `yaml:"extensions"`
+}
+
+type lockedBundle struct {
+	Version string `yaml:"version"`
+	Source  string `yaml:"source"`
+	// Checksum covers the manifest and the files of the bundle
+	Checksum string   `yaml:"sha256"`
+	Files    []string `yaml:"files"`
+}
+
+// readBundle reads a bundle from a directory, or from a tarball that has
+// the manifest at its root or in a single top-level directory.
+func readBundle(source string) (*extensionBundle, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	var lookup func(name string) ([]byte, error)
+	if info.IsDir() {
+		lookup = func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(source, name))
+		}
+	} else {
+		files, err := readTarball(source)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", source, err)
+		}
+		prefix, found := "", false
+		for name := range files {
+			if path.Base(name) != bundleManifestName {
+				continue
+			}
+			if dir := path.Dir(name); !found || len(dir) < len(prefix) {
+				prefix, found = dir, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has no %s", source, bundleManifestName)
+		}
+		lookup = func(name string) ([]byte, error) {
+			data, ok := files[path.Join(prefix, name)]
+			if !ok {
+				return nil, fmt.Errorf("%s is missing", name)
+			}
+			return data, nil
+		}
+	}
+
+	b := &extensionBundle{files: make(map[string][]byte)}
+	if b.manifestData, err = lookup(bundleManifestName); err != nil {
+		return nil, fmt.Errorf("error reading the manifest of %s: %v", source, err)
+	}
+	if err := yaml.Unmarshal(b.manifestData, &b.manifest); err != nil {
+		return nil, fmt.Errorf("error parsing the manifest of %s: %v", source, err)
+	}
+	if err := checkBundleManifest(b.manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %v", source, err)
+	}
+	for _, name := range b.manifest.Files {
+		data, err := lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from %s: %v", name, source, err)
+		}
+		b.files[name] = data
+	}
+	return b, nil
+}
+
+// readTarball returns the regular files of a tar archive, gzipped or not,
+// by their cleaned path.
+func readTarball(source string) (map[string][]byte, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > maxBundleFileSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes", header.Name, maxBundleFileSize)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(strings.TrimPrefix(header.Name, "./"))] = data
+	}
+}
+
+// checkBundleManifest checks the fields of a manifest, and that this xdocker
+// has the version the bundle needs.
+func checkBundleManifest(m bundleManifest) error {
+	if err := checkExtensionName(m.Name); err != nil {
+		return err
+	}
+	if _, err := parseSemver(m.Version); err != nil {
+		return err
+	}
+	ok, err := versionSatisfies(xdockerVersion, m.Xdocker)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s %s needs xdocker %s, this is xdocker %s", m.Name, m.Version, m.Xdocker, xdockerVersion)
+	}
+	if len(m.Files) == 0 {
+		return fmt.Errorf("files must list the files of the bundle")
+	}
+	seen := make(map[string]bool)
+	for _, name := range m.Files {
+		// bundles are flat, so a file cannot point outside of it
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("file %q must be a plain file name", name)
+		}
+		if name == bundleManifestName {
+			return fmt.Errorf("files must not list the manifest")
+		}
+		if seen[name] {
+			return fmt.Errorf("file %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// checksum returns the SHA-256 of the manifest and files of b.
+func (b *extensionBundle) checksum() string {
+	h := sha256.New()
+	h.Write(b.manifestData)
+	names := make([]string, 0, len(b.files))
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00", name, len(b.files[name]))
+		h.Write(b.files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bundleLocation returns the directory bundles are installed to and its
+// lockfile: the project's, or the user's.
+func bundleLocation(user bool) (string, string, error) {
+	if !user {
+		return localExtensionsDir, projectLockFile, nil
+	}
+	dir := userExtensionsDir()
+	if dir == "" {
+		return "", "", fmt.Errorf("cannot find the user extensions directory")
+	}
+	return dir, filepath.Join(filepath.Dir(dir), "extensions.lock"), nil
+}
+
+func readLockFile(lockFile string) (*extensionLock, error) {
+	lock := &extensionLock{}
+	data, err := os.ReadFile(lockFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", lockFile, err)
+	}
+	if lock.Extensions == nil {
+		lock.Extensions = make(map[string]lockedBundle)
+	}
+	return lock, nil
+}
+
+func writeLockFile(lockFile string, lock *extensionLock) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	header := "# Written by xdocker extensions install and uninstall.\n"
+	return os.WriteFile(lockFile, append([]byte(header), data...), 0644)
+}
+
+// installBundle installs the bundle at source into the project's or user's
+// extensions directory and records it in the lockfile. A bundle pinned in
+// the lockfile can only be installed with the version and content recorded
+// there, unless force is set.
+func installBundle(source string, user, force bool) error {
+	b, err := readBundle(source)
+	if err != nil {
+		return err
+	}
+	m := b.manifest
+	dir, lockFile, err := bundleLocation(user)
+	if err != nil {
+		return err
+	}
+	lock, err := readLockFile(lockFile)
+	if err != nil {
+		return err
+	}
+	sum := b.checksum()
+	if locked, ok := lock.Extensions[m.Name]; ok && !force {
+		if locked.Version != m.Version {
+			return fmt.Errorf("%s %s is pinned in %s; pass --force to replace it with %s", m.Name, locked.Version, lockFile, m.Version)
+		}
+		if locked.Checksum != sum {
+			return fmt.Errorf("%s %s differs from the one pinned in %s; pass --force to replace it", m.Name, m.Version, lockFile)
+		}
+	}
+
+	target := filepath.Join(dir, m.Name)
+	if _, err := os.Stat(target); err == nil {
+		if _, err := os.Stat(filepath.Join(target, bundleManifestName)); err != nil {
+			return fmt.Errorf("%s exists and is not an installed bundle", target)
+		}
+	}
+
+	// The bundle is written to a staging directory first, so a bundle that
+	// does not load leaves the installed extensions alone
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(dir, ".install-"+m.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.WriteFile(filepath.Join(staging, bundleManifestName), b.manifestData, 0644); err != nil {
+		return err
+	}
+	for name, data := range b.files {
+		if err := os.WriteFile(filepath.Join(staging, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	if err := checkBundleExtensions(dir, target, staging); err != nil {
+		return fmt.Errorf("cannot install %s %s:\n  %v", m.Name, m.Version, err)
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		return err
+	}
+	lock.Extensions[m.Name] = lockedBundle{Version: m.Version, Source: source, Checksum: sum, Files: m.Files}
+	if err := writeLockFile(lockFile, lock); err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s %s into %s\n", m.Name, m.Version, target)
+	return nil
+}
+
+// checkBundleExtensions checks the extensions of a bundle staged for
+// installation, and that they do not clash with the other extensions of the
+// directory it is installed to. target is where the bundle goes, replacing
+// an older version.
+func checkBundleExtensions(dir, target, staging string) error {
+	files, err := extensionFiles(staging)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	staged := make([]Extension, 0, len(files))
+	for _, filePath := range files {
+		for _, problem := range validateExtensionFile(filePath) {
+			problems = append(problems, fmt.Sprintf("%s: %s", filepath.Base(filePath), problem))
+		}
+		if ext, err := loadExtension(filePath); err == nil {
+			staged = append(staged, ext)
+		}
+	}
+
+	others, err := extensionFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, filePath := range others {
+		if filepath.Dir(filePath) == filepath.Clean(target) {
+			continue
+		}
+		other, err := loadExtension(filePath)
+		if err != nil {
+			continue
+		}
+		for _, ext := range staged {
+			if ext.Name == other.Name {
+				problems = append(problems, fmt.Sprintf("extension %s is already defined in %s", ext.Name, filePath))
+			} else if ext.Path != "" && ext.Path == other.Path {
+				problems = append(problems, fmt.Sprintf("extension %s claims the path %s, like %s", ext.Name, ext.Path, filePath))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// uninstallBundle removes an installed bundle and its lockfile entry.
+func uninstallBundle(name string, user bool) error {
+	dir, lockFile, err := bundleLocation(user)
+	if err != nil {
+		return err
+	}
+	lock, err := readLockFile(lockFile)
+	if err != nil {
+		return err
+	}
+	if _, ok := lock.Extensions[name]; !ok {
+		return fmt.Errorf("%s is not installed (not found in %s)", name, lockFile)
+	}
+	if err := checkExtensionName(name); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(filepath.Join(target, bundleManifestName)); err == nil {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	delete(lock.Extensions, name)
+	if err := writeLockFile(lockFile, lock); err != nil {
+		return err
+	}
+	fmt.Printf("Uninstalled %s from %s\n", name, target)
+	return nil
+}
+
+// checkLockFile returns the bundles of a lockfile that are not installed in
+// dir with the locked version.
+func checkLockFile(dir, lockFile string) []string {
+	if _, err := os.Stat(lockFile); os.IsNotExist(err) {
+		return nil
+	}
+	lock, err := readLockFile(lockFile)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	names := make([]string, 0, len(lock.Extensions))
+	for name := range lock.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		locked := lock.Extensions[name]
+		data, err := os.ReadFile(filepath.Join(dir, name, bundleManifestName))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s is locked but not installed; run xdocker extensions install %s", name, locked.Version, locked.Source))
+			continue
+		}
+		var m bundleManifest
+		if err := yaml.Unmarshal(data, &m); err != nil || m.Version != locked.Version {
+			problems = append(problems, fmt.Sprintf("%s is installed with version %s, but %s is locked", name, m.Version, locked.Version))
+		}
+	}
+	return problems
+}
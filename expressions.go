@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+)
+
+// maxValueDepth limits how deeply the tables, lists and objects returned by
+// scripts may nest.
+const maxValueDepth = 100
+
+// luaToGo converts the Lua value at index to the Go value yaml.v3 would
+// produce for it: integral numbers become int, tables with keys 1..n become
+// lists and other tables maps with string keys. Tables that contain
+// themselves or nest deeper than maxValueDepth are an error.
+func luaToGo(l *lua.State, index int) (interface{}, error) {
+	return luaValueToGo(l, index, make(map[interface{}]bool), 0)
+}
+
+// luaValueToGo converts a value depth levels below the one given to luaToGo.
+// parents are the tables being converted around it.
+func luaValueToGo(l *lua.State, index int, parents map[interface{}]bool, depth int) (interface{}, error) {
+	index = l.AbsIndex(index)
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return nil, nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index), nil
+	case lua.TypeNumber:
+		n, _ := l.ToNumber(index)
+		return normalizeNumber(n), nil
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return s, nil
+	case lua.TypeTable:
+		table := l.ToValue(index)
+		if parents[table] {
+			return nil, fmt.Errorf("table contains itself")
+		}
+		if depth >= maxValueDepth {
+			return nil, fmt.Errorf("tables nested more than %d levels deep", maxValueDepth)
+		}
+		// the key and value of each entry are pushed
+		if !l.CheckStack(2) {
+			return nil, fmt.Errorf("tables nested too deep for the Lua stack")
+		}
+		parents[table] = true
+		defer delete(parents, table)
+
+		m := make(map[string]interface{})
+		var keys []interface{}
+		l.PushNil()
+		for l.Next(index) {
+			key, err := luaValueToGo(l, -2, parents, depth+1)
+			if err != nil {
+				l.Pop(2)
+				return nil, err
+			}
+			value, err := luaValueToGo(l, -1, parents, depth+1)
+			if err != nil {
+				l.Pop(2)
+				return nil, err
+			}
+			keys = append(keys, key)
+			m[fmt.Sprintf("%v", key)] = value
+			l.Pop(1)
+		}
+		if list, ok := luaSequence(keys, m); ok {
+			return list, nil
+		}
+		return m, nil
+	}
+	s, _ := l.ToString(index)
+	return s, nil
+}
+
+// luaSequence returns the table as a list when its keys are exactly 1..n.
+func luaSequence(keys []interface{}, m map[string]interface{}) ([]interface{}, bool) {
+	if len(keys) == 0 {
+		return nil, false
+	}
+	list := make([]interface{}, len(keys))
+	for _, key := range keys {
+		i, ok := key.(int)
+		if !ok || i < 1 || i > len(keys) {
+			return nil, false
+		}
+		list[i-1] = m[strconv.Itoa(i)]
+	}
+	return list, true
+}
+
+// jsToGo converts a JavaScript value to the Go value yaml.v3 would produce.
+// Objects that contain themselves or nest deeper than maxValueDepth are an
+// error.
+func jsToGo(value goja.Value) (interface{}, error) {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil, nil
+	}
+	return normalizeExported(value.Export())
+}
+
+// normalizeExported converts the numbers of a value exported from
+// JavaScript, or decoded from JSON, in place.
+func normalizeExported(value interface{}) (interface{}, error) {
+	return normalizeValue(value, make(map[uintptr]bool), 0)
+}
+
+// normalizeValue normalizes a value depth levels below the one given to
+// normalizeExported. parents are the lists and maps around it; goja exports
+// an object that refers to itself as a map or list that contains itself.
+func normalizeValue(value interface{}, parents map[uintptr]bool, depth int) (interface{}, error) {
+	switch v := value.(type) {
+	case int64:
+		return int(v), nil
+	case float64:
+		return normalizeNumber(v), nil
+	case []interface{}:
+		leave, err := enterValue(v, parents, depth)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		for i, item := range v {
+			if v[i], err = normalizeValue(item, parents, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		leave, err := enterValue(v, parents, depth)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		for key, item := range v {
+			if v[key], err = normalizeValue(item, parents, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// enterValue records the list or map v as a parent of the values below it,
+// unless it is one already or too deep. The returned function removes it.
+func enterValue(v interface{}, parents map[uintptr]bool, depth int) (func(), error) {
+	if depth >= maxValueDepth {
+		return nil, fmt.Errorf("objects nested more than %d levels deep", maxValueDepth)
+	}
+	id := reflect.ValueOf(v).Pointer()
+	if id == 0 {
+		// empty lists have nothing below them
+		return func() {}, nil
+	}
+	if parents[id] {
+		return nil, fmt.Errorf("object contains itself")
+	}
+	parents[id] = true
+	return func() { delete(parents, id) }, nil
+}
+
+func normalizeNumber(n float64) interface{} {
+	if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+		return int(n)
+	}
+	return n
+}
+
+// formatExpressionResult renders an expression result that is embedded in a
+// larger string. Lists and maps are rendered as JSON.
+func formatExpressionResult(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(v)
+		if err == nil {
+			return string(data)
+		}
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+)
+
+// nested returns the source of a value nested depth levels deep in Lua or
+// JavaScript syntax.
+func nested(lang string, depth int) string {
+	open, close := "{a=", "}"
+	if lang == "js" {
+		open = "{a:"
+	}
+	return strings.Repeat(open, depth) + "1" + strings.Repeat(close, depth)
+}
+
+func TestScriptValueToGo(t *testing.T) {
+	tests := []struct {
+		name, lang, src string
+		want            interface{}
+		err             string
+	}{
+		{name: "lua list", lang: "lua", src: `return {1, "b", 2.5}`, want: []interface{}{1, "b", 2.5}},
+		{name: "lua map", lang: "lua", src: `return {a = {true}, [2] = "x"}`, want: map[string]interface{}{"a": []interface{}{true}, "2": "x"}},
+		{name: "lua shared table", lang: "lua", src: `local s = {1} return {a = s, b = s}`, want: map[string]interface{}{"a": []interface{}{1}, "b": []interface{}{1}}},
+		{name: "lua deep table", lang: "lua", src: "return " + nested("lua", 30), want: nil},
+		{name: "lua too deep", lang: "lua", src: "return " + nested("lua", maxValueDepth+1), err: "nested more than 100 levels"},
+		{name: "lua cycle", lang: "lua", src: `local t = {} t.self = t return t`, err: "table contains itself"},
+		{name: "lua cycle in key", lang: "lua", src: `local t = {} t[t] = 1 return t`, err: "table contains itself"},
+
+		{name: "js object", lang: "js", src: `({a: [1, "b", 2.5], b: null})`, want: map[string]interface{}{"a": []interface{}{1, "b", 2.5}, "b": nil}},
+		{name: "js shared object", lang: "js", src: `var s = {x: 1}; ({a: s, b: s})`, want: map[string]interface{}{"a": map[string]interface{}{"x": 1}, "b": map[string]interface{}{"x": 1}}},
+		{name: "js deep object", lang: "js", src: "(" + nested("js", 30) + ")", want: nil},
+		{name: "js too deep", lang: "js", src: "(" + nested("js", maxValueDepth+1) + ")", err: "nested more than 100 levels"},
+		{name: "js cycle", lang: "js", src: `var t = {}; t.self = t; t`, err: "object contains itself"},
+		{name: "js list cycle", lang: "js", src: `var a = [1]; a.push({list: a}); a`, err: "object contains itself"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got interface{}
+			var err error
+			if test.lang == "lua" {
+				l := newLuaState(false)
+				if err := lua.DoString(l, test.src); err != nil {
+					t.Fatal(err)
+				}
+				got, err = luaToGo(l, 1)
+				if err == nil && l.Top() != 1 {
+					t.Errorf("stack has %d values after the conversion, want 1", l.Top())
+				}
+			} else {
+				value, runErr := goja.New().RunString(test.src)
+				if runErr != nil {
+					t.Fatal(runErr)
+				}
+				got, err = jsToGo(value)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want != nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
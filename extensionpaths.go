@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathVariables are the placeholders an extension path can start with, and
+// the top-level section whose entries they stand for.
+var pathVariables = map[string]string{
+	"$service": "services",
+	"$network": "networks",
+	"$volume":  "volumes",
+	"$secret":  "secrets",
+	"$config":  "configs",
+}
+
+// extensionTarget is a place an extension applies to: the map that contains
+// its key, and the path of that map from the document root.
+type extensionTarget struct {
+	container map[string]interface{}
+	path      []string
+}
+
+// parseExtensionPath splits an extension path such as
+// `/$service/deploy/autoscale` into the segments leading to the map that
+// holds the extension's key, and that key. Segments are map keys, glob
+// patterns over map keys (`x-*`), or `*` and indexes for list items.
+func parseExtensionPath(p string) ([]string, string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, "", fmt.Errorf("path %q must start with /", p)
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	key := parts[len(parts)-1]
+	if key == "" || strings.ContainsAny(key, "*?[") || strings.HasPrefix(key, "$") {
+		return nil, "", fmt.Errorf("path %q must end with the key of the extension", p)
+	}
+
+	var segments []string
+	for i, part := range parts[:len(parts)-1] {
+		if strings.HasPrefix(part, "$") {
+			section, ok := pathVariables[part]
+			if !ok || i > 0 {
+				return nil, "", fmt.Errorf("path %q: unknown placeholder %s, expected $service, $network, $volume, $secret or $config at the start", p, part)
+			}
+			segments = append(segments, section, "*")
+			continue
+		}
+		if part == "" {
+			return nil, "", fmt.Errorf("path %q has an empty segment", p)
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, "", fmt.Errorf("path %q: invalid pattern %q", p, part)
+		}
+		segments = append(segments, part)
+	}
+	return segments, key, nil
+}
+
+// findExtensionTargets returns the maps below root the segments lead to, in
+// a stable order.
+func findExtensionTargets(root map[string]interface{}, segments []string) []extensionTarget {
+	var targets []extensionTarget
+	var walk func(node interface{}, segments, p []string)
+	walk = func(node interface{}, segments, p []string) {
+		if len(segments) == 0 {
+			if m, ok := node.(map[string]interface{}); ok {
+				targets = append(targets, extensionTarget{container: m, path: p})
+			}
+			return
+		}
+		segment := segments[0]
+		switch n := node.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(n))
+			for key := range n {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if matched, _ := path.Match(segment, key); matched {
+					walk(n[key], segments[1:], append(p[:len(p):len(p)], key))
+				}
+			}
+		case []interface{}:
+			for i, item := range n {
+				index := strconv.Itoa(i)
+				if segment == "*" || segment == index {
+					walk(item, segments[1:], append(p[:len(p):len(p)], index))
+				}
+			}
+		}
+	}
+	walk(root, segments, nil)
+	return targets
+}
+
+// configDocument returns the document root of config as a map, sharing the
+// section maps with it, so extensions can work on any part of the document.
+func configDocument(config *XDockerConfig) map[string]interface{} {
+	root := make(map[string]interface{}, len(config.Extra)+6)
+	for key, value := range config.Extra {
+		root[key] = value
+	}
+	if config.Name != "" {
+		root["name"] = config.Name
+	}
+	if len(config.Include) > 0 {
+		root["include"] = config.Include
+	}
+	sections := map[string]map[string]interface{}{
+		"services": config.Services,
+		"networks": config.Networks,
+		"volumes":  config.Volumes,
+		"secrets":  config.Secrets,
+		"configs":  config.Configs,
+	}
+	for key, section := range sections {
+		if section != nil {
+			root[key] = section
+		}
+	}
+	return root
+}
+
+// applyConfigDocument stores a document root built by configDocument, and
+// changed by extensions, back into config.
+func applyConfigDocument(config *XDockerConfig, root map[string]interface{}) error {
+	extra := make(map[string]interface{})
+	config.Name, config.Include = "", nil
+	config.Services, config.Networks, config.Volumes, config.Secrets, config.Configs = nil, nil, nil, nil, nil
+	for key, value := range root {
+		var section *map[string]interface{}
+		switch key {
+		case "name":
+			name, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("name must be a string, got %s", formatExpressionResult(value))
+			}
+			config.Name = name
+			continue
+		case "include":
+			include, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("include must be a list, got %s", formatExpressionResult(value))
+			}
+			config.Include = include
+			continue
+		case "services":
+			section = &config.Services
+		case "networks":
+			section = &config.Networks
+		case "volumes":
+			section = &config.Volumes
+		case "secrets":
+			section = &config.Secrets
+		case "configs":
+			section = &config.Configs
+		default:
+			extra[key] = value
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a mapping, got %s", key, formatExpressionResult(value))
+		}
+		*section = m
+	}
+	config.Extra = extra
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExtensionPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		segments []string
+		key      string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{path: "/tailscale", segments: nil, key: "tailscale"},
+		{path: "/$service/proxy", segments: []string{"services", "*"}, key: "proxy"},
+		{path: "/$network/subnet", segments: []string{"networks", "*"}, key: "subnet"},
+		{path: "/$service/deploy/autoscale", segments: []string{"services", "*", "deploy"}, key: "autoscale"},
+		{path: "/x-*/lint", segments: []string{"x-*"}, key: "lint"},
+		{path: "/$service/volumes/*/backup", segments: []string{"services", "*", "volumes", "*"}, key: "backup"},
+		{path: "/$service/ports/0/expose", segments: []string{"services", "*", "ports", "0"}, key: "expose"},
+		{path: "service/proxy", err: "must start with /"},
+		{path: "/$service/", err: "must end with the key of the extension"},
+		{path: "/$service/*", err: "must end with the key of the extension"},
+		{path: "/deploy/$service", err: "must end with the key of the extension"},
+		{path: "/$services/proxy", err: "unknown placeholder $services"},
+		{path: "/x/$service/proxy", err: "unknown placeholder $service"},
+		{path: "/$service//proxy", err: "has an empty segment"},
+		{path: "/x-[/lint", err: `invalid pattern "x-["`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			segments, key, err := parseExtensionPath(test.path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("parseExtensionPath(%q) error = %v, want one containing %q", test.path, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExtensionPath(%q): %v", test.path, err)
+			}
+			if !reflect.DeepEqual(segments, test.segments) || key != test.key {
+				t.Errorf("parseExtensionPath(%q) = %q, %q, want %q, %q", test.path, segments, key, test.segments, test.key)
+			}
+		})
+	}
+}
+
+func TestFindExtensionTargets(t *testing.T) {
+	root := map[string]interface{}{
+		"services": map[string]interface{}{
+			"web": map[string]interface{}{
+				"deploy":  map[string]interface{}{"replicas": 2},
+				"volumes": []interface{}{"data:/data", map[string]interface{}{"target": "/logs"}, map[string]interface{}{"target": "/tmp"}},
+			},
+			"db":    map[string]interface{}{"image": "postgres"},
+			"cache": nil,
+		},
+		"x-defaults": map[string]interface{}{"lint": true},
+		"x-extra":    map[string]interface{}{},
+		"xdefaults":  map[string]interface{}{},
+	}
+
+	tests := []struct {
+		path string
+		// want are the paths of the targets found
+		want []string
+	}{
+		{path: "/proxy", want: []string{""}},
+		{path: "/$service/proxy", want: []string{"services.db", "services.web"}},
+		{path: "/$service/deploy/autoscale", want: []string{"services.web.deploy"}},
+		{path: "/x-*/lint", want: []string{"x-defaults", "x-extra"}},
+		{path: "/$service/volumes/*/backup", want: []string{"services.web.volumes.1", "services.web.volumes.2"}},
+		{path: "/$service/volumes/2/backup", want: []string{"services.web.volumes.2"}},
+		{path: "/$service/volumes/5/backup", want: nil},
+		{path: "/$network/subnet", want: nil},
+		{path: "/$service/healthcheck/retry", want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			segments, _, err := parseExtensionPath(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, target := range findExtensionTargets(root, segments) {
+				got = append(got, strings.Join(target.path, "."))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findExtensionTargets(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+)
+
+const extensionsUsage = "Usage: xdocker extensions list | describe <name> | validate | test [<name>...] | new <name> [--lang lua|js] | install [--user] [--force] <path|tarball> | uninstall [--user] <name>"
+
+// runExtensionsCommand runs the `xdocker extensions` subcommands, which
+// inspect and scaffold extensions.
+func runExtensionsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", extensionsUsage)
+	}
+	switch args[0] {
+	case "list":
+		if err := loadExtensions(); err != nil {
+			return err
+		}
+		return listExtensions()
+	case "describe":
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: xdocker extensions describe <name>")
+		}
+		if err := loadExtensions(); err != nil {
+			return err
+		}
+		return describeExtension(args[1])
+	case "validate":
+		return validateExtensions()
+	case "test":
+		if err := loadExtensions(); err != nil {
+			return err
+		}
+		return testExtensions(args[1:])
+	case "install":
+		installCmd := flag.NewFlagSet("extensions install", flag.ExitOnError)
+		user := installCmd.Bool("user", false, "Install for the user instead of the project")
+		force := installCmd.Bool("force", false, "Replace a bundle pinned to another version or content in the lockfile")
+		installCmd.Parse(args[1:])
+		if installCmd.NArg() != 1 {
+			return fmt.Errorf("Usage: xdocker extensions install [--user] [--force] <path|tarball>")
+		}
+		return installBundle(installCmd.Arg(0), *user, *force)
+	case "uninstall":
+		uninstallCmd := flag.NewFlagSet("extensions uninstall", flag.ExitOnError)
+		user := uninstallCmd.Bool("user", false, "Uninstall from the user instead of the project")
+		uninstallCmd.Parse(args[1:])
+		if uninstallCmd.NArg() != 1 {
+			return fmt.Errorf("Usage: xdocker extensions uninstall [--user] <name>")
+		}
+		return uninstallBundle(uninstallCmd.Arg(0), *user)
+	case "new":
+		newCmd := flag.NewFlagSet("extensions new", flag.ExitOnError)
+		lang := newCmd.String("lang", "lua", "Language of the generate script: lua or js")
+		newCmd.Parse(args[1:])
+		// the flag may also follow the name
+		name := newCmd.Arg(0)
+		if newCmd.NArg() > 0 {
+			newCmd.Parse(newCmd.Args()[1:])
+		}
+		if name == "" || newCmd.NArg() > 0 {
+			return fmt.Errorf("Usage: xdocker extensions new <name> [--lang lua|js]")
+		}
+		return newExtension(name, *lang)
+	}
+	return fmt.Errorf("unknown extensions command %q\n%s", args[0], extensionsUsage)
+}
+
+// listExtensions prints the loaded extensions in the order they run.
+func listExtensions() error {
+	names, err := extensionOrder(extensions)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPATH\tLANG\tHOOKS\tSOURCE")
+	for _, name := range names {
+		ext := extensions[name]
+		path, lang, hooks := ext.Path, "-", "-"
+		if path == "" {
+			path = "-"
+		}
+		if strings.TrimSpace(ext.Generate) != "" {
+			lang, _ = extensionScript(ext)
+		}
+		if events := extensionHookEvents(ext); len(events) > 0 {
+			hooks = strings.Join(events, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ext.Name, path, lang, hooks, ext.Source)
+	}
+	return w.Flush()
+}
+
+// describeExtension prints an extension and its arguments.
+func describeExtension(name string) error {
+	ext, ok := extensions[name]
+	if !ok {
+		names := make([]string, 0, len(extensions))
+		for n := range extensions {
+			names = append(names, n)
+		}
+		return fmt.Errorf("unknown extension %q%s", name, didYouMean(name, names))
+	}
+	fmt.Printf("name:        %s\n", ext.Name)
+	if ext.Description != "" {
+		fmt.Printf("description: %s\n", ext.Description)
+	}
+	if ext.Path != "" {
+		fmt.Printf("path:        %s\n", ext.Path)
+	}
+	if strings.TrimSpace(ext.Generate) != "" {
+		lang, _ := extensionScript(ext)
+		fmt.Printf("language:    %s\n", lang)
+	}
+	fmt.Printf("source:      %s\n", ext.Source)
+	fmt.Printf("required:    %t\n", ext.Required)
+	if ext.Trusted {
+		fmt.Printf("trusted:     true\n")
+	}
+	if ext.Priority != 0 {
+		fmt.Printf("priority:    %d\n", ext.Priority)
+	}
+	if len(ext.After) > 0 {
+		fmt.Printf("after:       %s\n", strings.Join(ext.After, ", "))
+	}
+	if len(ext.Merge) > 0 {
+		keys := make([]string, 0, len(ext.Merge))
+		for key := range ext.Merge {
+			keys = append(keys, key+"="+ext.Merge[key])
+		}
+		sort.Strings(keys)
+		fmt.Printf("merge:       %s\n", strings.Join(keys, ", "))
+	}
+	if events := extensionHookEvents(ext); len(events) > 0 {
+		hooks := make([]string, len(events))
+		for i, event := range events {
+			lang, _ := hookScript(ext.Hooks[event])
+			hooks[i] = fmt.Sprintf("%s (%s)", event, lang)
+		}
+		fmt.Printf("hooks:       %s\n", strings.Join(hooks, ", "))
+	}
+
+	if len(ext.Arguments) == 0 {
+		fmt.Println("arguments:   none")
+		return nil
+	}
+	fmt.Println("arguments:")
+	argNames := make([]string, 0, len(ext.Arguments))
+	for argName := range ext.Arguments {
+		argNames = append(argNames, argName)
+	}
+	sort.Strings(argNames)
+	for _, argName := range argNames {
+		fmt.Printf("  %s\n", argumentUsage(argName, ext.Arguments[argName]))
+	}
+	return nil
+}
+
+// validateExtensions checks every extension file of the extension
+// directories, compiling the generate scripts without running them, and then
+// the extensions together. Each file is reported, whether it fails or not.
+func validateExtensions() error {
+	files, failed := 0, 0
+	for _, dir := range extensionDirs() {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		paths, err := extensionFiles(dir)
+		if err != nil {
+			return fmt.Errorf("error reading extensions directory %s: %v", dir, err)
+		}
+		for _, filePath := range paths {
+			files++
+			problems := validateExtensionFile(filePath)
+			if len(problems) == 0 {
+				fmt.Printf("ok    %s\n", filePath)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL  %s\n", filePath)
+			for _, problem := range problems {
+				fmt.Printf("      %s\n", problem)
+			}
+		}
+	}
+	for _, user := range []bool{false, true} {
+		dir, lockFile, err := bundleLocation(user)
+		if err != nil {
+			continue
+		}
+		problems := checkLockFile(dir, lockFile)
+		if len(problems) == 0 {
+			continue
+		}
+		files++
+		failed++
+		fmt.Printf("FAIL  %s\n", lockFile)
+		for _, problem := range problems {
+			fmt.Printf("      %s\n", problem)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d extension files failed validation", failed, files)
+	}
+
+	if err := loadExtensions(); err != nil {
+		return err
+	}
+	if _, err := extensionOrder(extensions); err != nil {
+		return err
+	}
+	fmt.Printf("%d extension files are valid\n", files)
+	return nil
+}
+
+// validateExtensionFile returns the problems of a single extension file.
+func validateExtensionFile(filePath string) []string {
+	ext, err := loadExtension(filePath)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	if strings.TrimSpace(ext.Generate) == "" && len(ext.Hooks) == 0 {
+		problems = append(problems, "generate script is empty")
+	}
+	argNames := make([]string, 0, len(ext.Arguments))
+	for argName := range ext.Arguments {
+		argNames = append(argNames, argName)
+	}
+	sort.Strings(argNames)
+	for _, argName := range argNames {
+		arg := ext.Arguments[argName]
+		if !argumentTypes[arg.Type] {
+			problems = append(problems, fmt.Sprintf("argument %q: unsupported type %q", argName, arg.Type))
+			continue
+		}
+		if arg.Default != nil && arg.Type != "env" {
+			if _, err := convertArgument(arg, arg.Default); err != nil {
+				problems = append(problems, fmt.Sprintf("argument %q: default: %v", argName, err))
+			}
+		}
+	}
+	if strings.TrimSpace(ext.Generate) != "" {
+		lang, expr := extensionScript(ext)
+		if err := compileScript(ext.Source, lang, expr); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, event := range extensionHookEvents(ext) {
+		lang, src := hookScript(ext.Hooks[event])
+		if err := compileScript(ext.Source, lang, src); err != nil {
+			problems = append(problems, fmt.Sprintf("%s hook: %v", event, err))
+		}
+	}
+	return problems
+}
+
+// extensionHookEvents returns the events ext has hooks for, in the order
+// they happen.
+func extensionHookEvents(ext Extension) []string {
+	var events []string
+	for _, event := range hookEvents {
+		if _, ok := ext.Hooks[event]; ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// compileScript compiles a Lua or JavaScript script without running it.
+// Shell commands are not checked.
+func compileScript(name, lang, expr string) error {
+	switch lang {
+	case "lua":
+		l := lua.NewState()
+		if err := lua.LoadString(l, expr); err != nil {
+			// the message is left on the stack
+			if msg, ok := l.ToString(-1); ok {
+				return fmt.Errorf("Lua syntax error: %s", msg)
+			}
+			return fmt.Errorf("Lua syntax error: %v", err)
+		}
+	case "js":
+		if _, err := goja.Compile(name, jsExtensionSource(expr), false); err != nil {
+			return fmt.Errorf("JavaScript syntax error: %v", err)
+		}
+	}
+	return nil
+}
+
+// extensionTemplates are the files written by `xdocker extensions new`, by
+// language. %[1]s is the name of the extension.
+var extensionTemplates = map[string]string{
+	"lua": `name: %[1]s
+description: "Describe what %[1]s does"
+path: /$service/%[1]s
+arguments:
+  value:
+    type: string
+    description: "The value given to %[1]s"
+    required: true
+generate: |
+  {{
+    -- return a table, or a YAML string, to merge into the service
+    return {
+      labels = {
+        ["%[1]s"] = value
+      }
+    }
+  }}
+`,
+	"js": `name: %[1]s
+description: "Describe what %[1]s does"
+path: /$service/%[1]s
+arguments:
+  value:
+    type: string
+    description: "The value given to %[1]s"
+    required: true
+generate: |
+  [[
+    // return an object, or a YAML string, to merge into the service
+    return {
+      labels: {
+        "%[1]s": value
+      }
+    };
+  ]]
+`,
+}
+
+// checkExtensionName checks that name can be used as a file name in an
+// extensions directory.
+func checkExtensionName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\ `) || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "$") {
+		return fmt.Errorf("invalid extension name %q", name)
+	}
+	return nil
+}
+
+// newExtension writes a template for a new extension to the project
+// extensions directory.
+func newExtension(name, lang string) error {
+	template, ok := extensionTemplates[lang]
+	if !ok {
+		return fmt.Errorf("unsupported language %q, expected lua or js", lang)
+	}
+	if err := checkExtensionName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(localExtensionsDir, 0755); err != nil {
+		return err
+	}
+	filePath := filepath.Join(localExtensionsDir, name+".yml")
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("extension file %s already exists", filePath)
+		}
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, template, name); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s\n", filePath)
+	return nil
+}
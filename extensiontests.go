@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// extensionTestSuffix marks the fixture files next to an extension file:
+// the tests of `extensions/skip.yml` are in `extensions/skip.test.yml`.
+const extensionTestSuffix = ".test"
+
+// defaultTestService is the name of the service a fixture is run as.
+const defaultTestService = "app"
+
+// extensionTestFile is a fixture file with the test cases of an extension.
+type extensionTestFile struct {
+	Tests []extensionTest `yaml:"tests"`
+}
+
+// extensionTest is a single test case. For extensions on services, input
+// and expected are a service, and generated, if given, is the rest of the
+// document the extension produced; for other paths input and expected are
+// whole documents. A case with error expects processing to fail with a
+// message containing it.
+type extensionTest struct {
+	Name      string                 `yaml:"name"`
+	Service   string                 `yaml:"service"`
+	Input     interface{}            `yaml:"input"`
+	Expected  interface{}            `yaml:"expected"`
+	Generated map[string]interface{} `yaml:"generated"`
+	Error     string                 `yaml:"error"`
+}
+
+// isExtensionTestFile reports whether name is a fixture file rather than an
+// extension.
+func isExtensionTestFile(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return strings.HasSuffix(base, extensionTestSuffix)
+}
+
+// extensionTestFileOf returns the fixture file of ext, or "" if it has none.
+func extensionTestFileOf(ext Extension) string {
+	base := strings.TrimSuffix(ext.Source, filepath.Ext(ext.Source))
+	for _, fileExt := range []string{".yml", ".yaml"} {
+		candidate := base + extensionTestSuffix + fileExt
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// testExtensions runs the fixtures of the named extensions, or of all loaded
+// extensions, and reports every case. It fails when a case fails.
+func testExtensions(names []string) error {
+	if len(names) == 0 {
+		var err error
+		if names, err = extensionOrder(extensions); err != nil {
+			return err
+		}
+	}
+
+	total, failed := 0, 0
+	fail := func(title, problem string) {
+		failed++
+		fmt.Printf("FAIL  %s\n", title)
+		for _, line := range strings.Split(strings.TrimRight(problem, "\n"), "\n") {
+			fmt.Printf("      %s\n", line)
+		}
+	}
+	for _, name := range names {
+		ext, ok := extensions[name]
+		if !ok {
+			return fmt.Errorf("unknown extension %q", name)
+		}
+		fixture := extensionTestFileOf(ext)
+		if fixture == "" {
+			fmt.Printf("--    %s: no tests\n", name)
+			continue
+		}
+		tests, err := readExtensionTests(fixture)
+		if err != nil {
+			total++
+			fail(name, err.Error())
+			continue
+		}
+		for i, test := range tests {
+			total++
+			title := test.Name
+			if title == "" {
+				title = fmt.Sprintf("test %d", i+1)
+			}
+			if problem := runExtensionTest(ext, fixture, test); problem != "" {
+				fail(name+": "+title, problem)
+				continue
+			}
+			fmt.Printf("ok    %s: %s\n", name, title)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d extension tests failed", failed, total)
+	}
+	fmt.Printf("%d extension tests passed\n", total)
+	return nil
+}
+
+func readExtensionTests(fixture string) ([]extensionTest, error) {
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		return nil, err
+	}
+	var file extensionTestFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", fixture, err)
+	}
+	return file.Tests, nil
+}
+
+// runExtensionTest runs a test case of ext through the same steps as `up`,
+// with ext as the only extension, and returns what went wrong, if anything.
+func runExtensionTest(ext Extension, fixture string, test extensionTest) string {
+	onService := strings.HasPrefix(ext.Path, "/$service/")
+	service := test.Service
+	if service == "" {
+		service = defaultTestService
+	}
+
+	config := &XDockerConfig{}
+	if onService {
+		config.Services = map[string]interface{}{service: test.Input}
+	} else {
+		data, err := yaml.Marshal(test.Input)
+		if err != nil {
+			return err.Error()
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return fmt.Sprintf("invalid input document: %v", err)
+		}
+	}
+	config.FileName = fixture
+
+	loaded := extensions
+	extensions = map[string]Extension{ext.Name: ext}
+	defer func() { extensions = loaded }()
+
+	scripts, err := resolveAllEnvVariablesAndExpressions(config)
+	if err == nil {
+		err = validateCustomInstructions(config)
+	}
+	if err == nil {
+		err = processCustomInstructions(scripts)
+	}
+	if test.Error != "" {
+		if err == nil {
+			return fmt.Sprintf("expected an error containing %q, got none", test.Error)
+		}
+		if !strings.Contains(err.Error(), test.Error) {
+			return fmt.Sprintf("expected an error containing %q, got: %v", test.Error, err)
+		}
+		return ""
+	}
+	if err != nil {
+		return err.Error()
+	}
+
+	if !onService {
+		return compareYAML(test.Expected, configDocument(config))
+	}
+	if problem := compareYAML(test.Expected, config.Services[service]); problem != "" {
+		return problem
+	}
+	if test.Generated == nil {
+		return ""
+	}
+	generated := configDocument(config)
+	services := make(map[string]interface{})
+	for name, value := range config.Services {
+		if name != service {
+			services[name] = value
+		}
+	}
+	delete(generated, "services")
+	if len(services) > 0 {
+		generated["services"] = services
+	}
+	if problem := compareYAML(test.Generated, generated); problem != "" {
+		return "generated:\n" + problem
+	}
+	return ""
+}
+
+// compareYAML returns a diff of the YAML of expected and actual, or "" if
+// they are the same.
+func compareYAML(expected, actual interface{}) string {
+	want, err := yaml.Marshal(expected)
+	if err != nil {
+		return err.Error()
+	}
+	got, err := yaml.Marshal(actual)
+	if err != nil {
+		return err.Error()
+	}
+	if bytes.Equal(want, got) {
+		return ""
+	}
+	return "--- expected\n+++ actual\n" + lineDiff(string(want), string(got))
+}
+
+// lineDiff returns a unified listing of the lines of a and b, marking the
+// lines only in a with - and those only in b with +.
+func lineDiff(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(&out, "  %s\n", x[i])
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&out, "- %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", y[j])
+			j++
+		}
+	}
+	return out.String()
+}
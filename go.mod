@@ -1,8 +1,9 @@
 module github.com/tluyben/xdocker
 
-go 1.20
+go 1.22
 
 require (
+	github.com/dop251/goja v0.0.0-20240927123429-241b342198c2
 	github.com/joho/godotenv v1.5.1
 	github.com/tluyben/go-lua v0.0.0-20240927101853-151c0f85bb6a
 	golang.org/x/crypto v0.27.0
@@ -11,7 +12,6 @@ require (
 
 require (
 	github.com/dlclark/regexp2 v1.11.4 // indirect
-	github.com/dop251/goja v0.0.0-20240927123429-241b342198c2 // indirect
 	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
 	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	golang.org/x/sys v0.25.0 // indirect
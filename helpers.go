@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+	"gopkg.in/yaml.v3"
+)
+
+// secretsFileName is the file next to the compose file that keeps the values
+// generated by xdocker.secret, so they stay the same across runs.
+const secretsFileName = ".xdocker-secrets.yml"
+
+const secretAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// helperContext is what the `xdocker` helper library available to expressions
+// and extensions knows about the value being generated.
+type helperContext struct {
+	composeFile string
+	service     string
+	config      *XDockerConfig
+	// trusted lets the script read files outside the directory of the
+	// compose file
+	trusted bool
+}
+
+func newHelperContext(config *XDockerConfig, service string) *helperContext {
+	return &helperContext{composeFile: config.FileName, service: service, config: config}
+}
+
+// serviceOfPath returns the service a key path points into, if any.
+func serviceOfPath(path []string) string {
+	if len(path) > 1 && path[0] == "services" {
+		return path[1]
+	}
+	return ""
+}
+
+// resolvePath resolves a path relative to the directory of the compose file.
+// Untrusted scripts can only reach that directory and its subdirectories,
+// also through symbolic links, and get the path with the links resolved.
+func (h *helperContext) resolvePath(name string) (string, error) {
+	if filepath.IsAbs(name) && (h.trusted || trustScripts) {
+		return name, nil
+	}
+	dir := filepath.Dir(h.composeFile)
+	path := filepath.Join(dir, name)
+	if h.trusted || trustScripts {
+		return path, nil
+	}
+	outside := fmt.Errorf("%q is outside the directory of the compose file; set trusted: true or pass --trust to read it", name)
+	if filepath.IsAbs(name) {
+		return "", outside
+	}
+	realDir, err := realPath(dir)
+	if err != nil {
+		return "", err
+	}
+	realFile, err := realPath(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realDir, realFile); err != nil || !filepath.IsLocal(rel) {
+		return "", outside
+	}
+	return realFile, nil
+}
+
+// realPath returns the absolute path of path with its symbolic links
+// resolved. A file that does not exist yet is resolved through its
+// directory, but a link pointing nowhere is an error.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err == nil || !os.IsNotExist(err) {
+		return real, err
+	}
+	if _, lerr := os.Lstat(abs); lerr == nil {
+		return "", fmt.Errorf("%q is a link to a missing file", path)
+	}
+	dir, err := realPath(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+func (h *helperContext) readFile(name string) (string, error) {
+	path, err := h.resolvePath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// secret returns the secret stored under name in the secrets file, generating
+// and storing a random one of the given length the first time.
+func (h *helperContext) secret(name string, length int) (string, error) {
+	if length <= 0 {
+		length = 32
+	}
+	path, err := h.resolvePath(secretsFileName)
+	if err != nil {
+		return "", err
+	}
+	secrets := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := yaml.Unmarshal(data, &secrets); err != nil {
+		return "", fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if value, ok := secrets[name]; ok {
+		return value, nil
+	}
+
+	value := make([]byte, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(secretAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		value[i] = secretAlphabet[n.Int64()]
+	}
+	if secrets == nil {
+		secrets = make(map[string]string)
+	}
+	secrets[name] = string(value)
+	data, err = yaml.Marshal(secrets)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// configMap returns a copy of the merged configuration as plain values.
+func (h *helperContext) configMap() map[string]interface{} {
+	m := make(map[string]interface{})
+	if h.config == nil {
+		return m
+	}
+	for key, value := range h.config.Extra {
+		m[key] = copyValue(value)
+	}
+	if h.config.Name != "" {
+		m["name"] = h.config.Name
+	}
+	sections := map[string]map[string]interface{}{
+		"services": h.config.Services,
+		"networks": h.config.Networks,
+		"volumes":  h.config.Volumes,
+		"secrets":  h.config.Secrets,
+		"configs":  h.config.Configs,
+	}
+	for key, section := range sections {
+		if section != nil {
+			m[key] = copyValue(section)
+		}
+	}
+	return m
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func base64Decode(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	return string(data), err
+}
+
+func jsonEncode(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func jsonDecode(s string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err != nil {
+		return nil, err
+	}
+	return normalizeExported(value)
+}
+
+func yamlEncode(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	return string(data), err
+}
+
+func yamlDecode(s string) (interface{}, error) {
+	var value interface{}
+	err := yaml.Unmarshal([]byte(s), &value)
+	return value, err
+}
+
+// openLuaHelpers registers the `xdocker` helper table in l.
+func openLuaHelpers(l *lua.State, h *helperContext) {
+	// raise turns a Go error into a Lua error
+	raise := func(l *lua.State, err error) int {
+		lua.Errorf(l, "%s", err.Error())
+		return 0
+	}
+	lua.NewLibrary(l, []lua.RegistryFunction{
+		{Name: "env", Function: func(l *lua.State) int {
+			if value, ok := os.LookupEnv(lua.CheckString(l, 1)); ok {
+				l.PushString(value)
+			} else {
+				l.SetTop(2)
+			}
+			return 1
+		}},
+		{Name: "readFile", Function: func(l *lua.State) int {
+			data, err := h.readFile(lua.CheckString(l, 1))
+			if err != nil {
+				return raise(l, err)
+			}
+			l.PushString(data)
+			return 1
+		}},
+		{Name: "sha256", Function: func(l *lua.State) int {
+			l.PushString(sha256Hex(lua.CheckString(l, 1)))
+			return 1
+		}},
+		{Name: "base64encode", Function: func(l *lua.State) int {
+			l.PushString(base64.StdEncoding.EncodeToString([]byte(lua.CheckString(l, 1))))
+			return 1
+		}},
+		{Name: "base64decode", Function: func(l *lua.State) int {
+			data, err := base64Decode(lua.CheckString(l, 1))
+			if err != nil {
+				return raise(l, err)
+			}
+			l.PushString(data)
+			return 1
+		}},
+		{Name: "secret", Function: func(l *lua.State) int {
+			value, err := h.secret(lua.CheckString(l, 1), lua.OptInteger(l, 2, 32))
+			if err != nil {
+				return raise(l, err)
+			}
+			l.PushString(value)
+			return 1
+		}},
+		{Name: "split", Function: func(l *lua.State) int {
+			parts := strings.Split(lua.CheckString(l, 1), lua.CheckString(l, 2))
+			list := make([]interface{}, len(parts))
+			for i, part := range parts {
+				list[i] = part
+			}
+			pushLuaValue(l, list)
+			return 1
+		}},
+		{Name: "jsonEncode", Function: func(l *lua.State) int {
+			lua.CheckAny(l, 1)
+			value, err := luaToGo(l, 1)
+			if err != nil {
+				return raise(l, err)
+			}
+			data, err := jsonEncode(value)
+			if err != nil {
+				return raise(l, err)
+			}
+			l.PushString(data)
+			return 1
+		}},
+		{Name: "jsonDecode", Function: func(l *lua.State) int {
+			value, err := jsonDecode(lua.CheckString(l, 1))
+			if err != nil {
+				return raise(l, err)
+			}
+			pushLuaValue(l, value)
+			return 1
+		}},
+		{Name: "yamlEncode", Function: func(l *lua.State) int {
+			lua.CheckAny(l, 1)
+			value, err := luaToGo(l, 1)
+			if err != nil {
+				return raise(l, err)
+			}
+			data, err := yamlEncode(value)
+			if err != nil {
+				return raise(l, err)
+			}
+			l.PushString(data)
+			return 1
+		}},
+		{Name: "yamlDecode", Function: func(l *lua.State) int {
+			value, err := yamlDecode(lua.CheckString(l, 1))
+			if err != nil {
+				return raise(l, err)
+			}
+			pushLuaValue(l, value)
+			return 1
+		}},
+		{Name: "config", Function: func(l *lua.State) int {
+			pushLuaValue(l, h.configMap())
+			return 1
+		}},
+	})
+	if h.service != "" {
+		l.PushString(h.service)
+		l.SetField(-2, "service")
+	}
+	l.SetGlobal("xdocker")
+}
+
+// pushLuaValue pushes a Go value as produced by yaml.v3 onto the Lua stack.
+func pushLuaValue(l *lua.State, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		l.PushNil()
+	case bool:
+		l.PushBoolean(v)
+	case int:
+		l.PushInteger(v)
+	case int64:
+		l.PushNumber(float64(v))
+	case float64:
+		l.PushNumber(v)
+	case string:
+		l.PushString(v)
+	case []interface{}:
+		l.CreateTable(len(v), 0)
+		for i, item := range v {
+			pushLuaValue(l, item)
+			l.RawSetInt(-2, i+1)
+		}
+	case map[string]interface{}:
+		l.CreateTable(0, len(v))
+		for key, item := range v {
+			pushLuaValue(l, item)
+			l.SetField(-2, key)
+		}
+	case map[interface{}]interface{}:
+		l.CreateTable(0, len(v))
+		for key, item := range v {
+			pushLuaValue(l, item)
+			l.SetField(-2, fmt.Sprintf("%v", key))
+		}
+	default:
+		l.PushString(fmt.Sprintf("%v", v))
+	}
+}
+
+// openJSHelpers registers the `xdocker` helper object in vm and returns it.
+func openJSHelpers(vm *goja.Runtime, h *helperContext) *goja.Object {
+	xdocker := vm.NewObject()
+	xdocker.Set("env", func(name string, def goja.Value) goja.Value {
+		if value, ok := os.LookupEnv(name); ok {
+			return vm.ToValue(value)
+		}
+		if def == nil {
+			return goja.Undefined()
+		}
+		return def
+	})
+	xdocker.Set("readFile", h.readFile)
+	xdocker.Set("sha256", sha256Hex)
+	xdocker.Set("base64encode", func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	})
+	xdocker.Set("base64decode", base64Decode)
+	xdocker.Set("secret", func(name string, length int) (string, error) {
+		return h.secret(name, length)
+	})
+	xdocker.Set("split", strings.Split)
+	xdocker.Set("jsonEncode", func(value goja.Value) (string, error) {
+		v, err := jsToGo(value)
+		if err != nil {
+			return "", err
+		}
+		return jsonEncode(v)
+	})
+	xdocker.Set("jsonDecode", func(s string) (goja.Value, error) {
+		value, err := jsonDecode(s)
+		if err != nil {
+			return nil, err
+		}
+		return jsValue(vm, value)
+	})
+	xdocker.Set("yamlEncode", func(value goja.Value) (string, error) {
+		v, err := jsToGo(value)
+		if err != nil {
+			return "", err
+		}
+		return yamlEncode(v)
+	})
+	xdocker.Set("yamlDecode", func(s string) (goja.Value, error) {
+		value, err := yamlDecode(s)
+		if err != nil {
+			return nil, err
+		}
+		return jsValue(vm, value)
+	})
+	xdocker.Set("config", func() (goja.Value, error) {
+		return jsValue(vm, h.configMap())
+	})
+	if h.service != "" {
+		xdocker.Set("service", h.service)
+	}
+	vm.Set("xdocker", xdocker)
+	return xdocker
+}
+
+// jsValue converts a Go value to plain JavaScript objects and arrays, rather
+// than to wrappers around the Go maps and slices.
+func jsValue(vm *goja.Runtime, value interface{}) (goja.Value, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	return parse(goja.Undefined(), vm.ToValue(string(data)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "data.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"inside":   filepath.Join(dir, "sub"),
+		"outside":  outside,
+		"up":       "..",
+		"dangling": filepath.Join(dir, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{name: "sub/data.txt", want: filepath.Join(dir, "sub", "data.txt")},
+		{name: "new.txt", want: filepath.Join(dir, "new.txt")},
+		{name: "inside/data.txt", want: filepath.Join(dir, "sub", "data.txt")},
+		{name: "inside/new.txt", want: filepath.Join(dir, "sub", "new.txt")},
+		{name: "sub/../sub/data.txt", want: filepath.Join(dir, "sub", "data.txt")},
+		{name: "../data.txt", err: "outside the directory"},
+		{name: "/etc/hostname", err: "outside the directory"},
+		{name: "outside/data.txt", err: "outside the directory"},
+		{name: "outside/missing/new.txt", err: "outside the directory"},
+		{name: "up/data.txt", err: "outside the directory"},
+		{name: "dangling", err: "is a link to a missing file"},
+	}
+	h := &helperContext{composeFile: filepath.Join(dir, "xdocker-compose.yml")}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := h.resolvePath(test.name)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("resolvePath(%q) = %q, %v, want an error containing %q", test.name, got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePath(%q): %v", test.name, err)
+			}
+			if got != test.want {
+				t.Errorf("resolvePath(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
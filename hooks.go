@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tluyben/go-lua"
+)
+
+// hookEvents are the points of `up` and `down` at which the hooks of
+// extensions run, in the order they happen.
+var hookEvents = []string{"pre-generate", "post-generate", "pre-up", "post-up", "pre-down", "post-down"}
+
+func isHookEvent(event string) bool {
+	for _, e := range hookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// hookScript returns the language of a hook, "lua", "js" or "shell", and its
+// source. A hook without delimiters is a shell command.
+func hookScript(hook string) (lang, src string) {
+	return splitScript(hook, "shell")
+}
+
+// lifecycle runs the hooks of the extensions of a compose file.
+type lifecycle struct {
+	// outputFile is the generated docker compose file
+	outputFile string
+	scripts    *scriptContext
+	// extensions have hooks and run them in this order
+	extensions []Extension
+}
+
+// newLifecycle selects the extensions whose hooks run for the configuration
+// of scripts: those used in the document, and those without a path, which
+// apply to every compose file. It must be called before the extensions are
+// processed, which removes their keys.
+func newLifecycle(scripts *scriptContext, outputFile string) (*lifecycle, error) {
+	names, err := extensionOrder(extensions)
+	if err != nil {
+		return nil, err
+	}
+	lc := &lifecycle{outputFile: outputFile, scripts: scripts}
+	root := configDocument(scripts.config)
+	for _, name := range names {
+		ext := extensions[name]
+		if len(ext.Hooks) == 0 {
+			continue
+		}
+		if ext.Path == "" || extensionUsed(root, ext) {
+			lc.extensions = append(lc.extensions, ext)
+		}
+	}
+	return lc, nil
+}
+
+// extensionUsed reports whether the key of ext appears anywhere its path
+// leads to in the document root.
+func extensionUsed(root map[string]interface{}, ext Extension) bool {
+	segments, key, err := parseExtensionPath(ext.Path)
+	if err != nil {
+		return false
+	}
+	for _, target := range findExtensionTargets(root, segments) {
+		if _, ok := target.container[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the hooks for event. The first failing pre- hook aborts with its
+// error; post- hooks all run, and their failures are reported together.
+func (lc *lifecycle) run(event string) error {
+	if lc == nil {
+		return nil
+	}
+	var failures []string
+	for _, ext := range lc.extensions {
+		hook, ok := ext.Hooks[event]
+		if !ok {
+			continue
+		}
+		if err := lc.runHook(ext, event, hook); err != nil {
+			err = fmt.Errorf("%s hook of extension %s failed: %v", event, ext.Name, err)
+			if strings.HasPrefix(event, "pre-") {
+				return err
+			}
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (lc *lifecycle) runHook(ext Extension, event, hook string) error {
+	lang, src := hookScript(hook)
+	switch lang {
+	case "lua":
+		return lc.runLuaHook(ext, event, src)
+	case "js":
+		return lc.runJSHook(ext, event, src)
+	}
+	return lc.runShellHook(ext, event, src)
+}
+
+func (lc *lifecycle) runLuaHook(ext Extension, event, src string) error {
+	ctx := lc.scripts.runtimeFor(ext)
+	ctx.setService("")
+	l := ctx.lua
+	defer l.SetTop(0)
+	restore := ctx.setLuaGlobals(lc.globals(event))
+	defer restore()
+
+	stop := limitLua(l, ctx.trusted)
+	defer stop()
+	return lua.DoString(l, src)
+}
+
+func (lc *lifecycle) runJSHook(ext Extension, event, src string) error {
+	ctx := lc.scripts.runtimeFor(ext)
+	ctx.setService("")
+	restore, err := ctx.setJSGlobals(lc.globals(event))
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	stop := limitJS(ctx.js, ctx.trusted)
+	defer stop()
+	_, err = ctx.js.RunString(jsExtensionSource(src))
+	return err
+}
+
+// runShellHook runs a shell command with the hook globals as environment
+// variables and the merged configuration as JSON on its standard input.
+// Shell commands run outside the sandbox, so only trusted extensions can
+// have them.
+func (lc *lifecycle) runShellHook(ext Extension, event, src string) error {
+	if !ext.Trusted && !trustScripts {
+		return fmt.Errorf("shell hooks only run for trusted extensions; set trusted: true in %s or pass --trust", ext.Source)
+	}
+	config, err := jsonEncode(lc.scripts.helpers.configMap())
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sh", "-c", src)
+	cmd.Env = os.Environ()
+	for name, value := range lc.globals(event) {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%v", name, value))
+	}
+	cmd.Stdin = bytes.NewReader([]byte(config))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// globals are the variables every hook gets.
+func (lc *lifecycle) globals(event string) map[string]interface{} {
+	return map[string]interface{}{
+		"XDOCKER_EVENT":        event,
+		"XDOCKER_COMPOSE_FILE": lc.scripts.helpers.composeFile,
+		"XDOCKER_OUTPUT_FILE":  lc.outputFile,
+		"XDOCKER_ENV":          xdockerEnv,
+	}
+}
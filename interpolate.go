@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// interpolateEnv resolves environment variable references in s using the
+// Compose interpolation grammar:
+//
+//	$VAR, ${VAR}       value of VAR, which must be set
+//	${VAR:-default}    default when VAR is unset or empty
+//	${VAR-default}     default when VAR is unset
+//	${VAR:?message}    error when VAR is unset or empty
+//	${VAR?message}     error when VAR is unset
+//	${VAR:+alt}        alt when VAR is set and not empty, empty otherwise
+//	${VAR+alt}         alt when VAR is set, empty otherwise
+//	$$                 a literal dollar sign
+//
+// Defaults and alternatives may contain references themselves. `$$` is kept
+// as `$$` in the result, as docker-compose interpolates the generated file
+// again and turns it into a single `$` there.
+func interpolateEnv(s string) (string, error) {
+	var missing []string
+	result, err := interpolateEnvInto(s, &missing)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+func interpolateEnvInto(s string, missing *[]string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		next := s[i+1]
+		switch {
+		case next == '$':
+			b.WriteString("$$")
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format in %q: unclosed ${", s)
+			}
+			value, err := interpolateBraced(s[i+2:end], missing)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		case isNameStart(next):
+			end := i + 1
+			for end < len(s) && isNameChar(s[end]) {
+				end++
+			}
+			name := s[i+1 : end]
+			if value, exists := os.LookupEnv(name); exists {
+				b.WriteString(value)
+			} else {
+				*missing = append(*missing, name)
+			}
+			i = end - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// interpolateBraced resolves the body of a ${...} reference.
+func interpolateBraced(body string, missing *[]string) (string, error) {
+	end := 0
+	for end < len(body) && isNameChar(body[end]) {
+		end++
+	}
+	name, rest := body[:end], body[end:]
+	if name == "" || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", body)
+	}
+	value, set := os.LookupEnv(name)
+	if rest == "" {
+		if !set {
+			*missing = append(*missing, name)
+		}
+		return value, nil
+	}
+
+	emptyIsUnset := strings.HasPrefix(rest, ":")
+	if emptyIsUnset {
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", body)
+	}
+	operator, word := rest[0], rest[1:]
+	present := set && !(emptyIsUnset && value == "")
+
+	switch operator {
+	case '-':
+		if present {
+			return value, nil
+		}
+		return interpolateEnvInto(word, missing)
+	case '+':
+		if present {
+			return interpolateEnvInto(word, missing)
+		}
+		return "", nil
+	case '?':
+		if present {
+			return value, nil
+		}
+		message, err := interpolateEnvInto(word, missing)
+		if err != nil {
+			return "", err
+		}
+		if message == "" {
+			message = "is not set"
+			if set {
+				message = "is empty"
+			}
+		}
+		return "", fmt.Errorf("required variable %s: %s", name, message)
+	}
+	return "", fmt.Errorf("invalid interpolation format for ${%s}", body)
+}
+
+// matchingBrace returns the index of the } closing the { at open, taking
+// nested ${...} references into account, or -1.
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || c >= '0' && c <= '9'
+}
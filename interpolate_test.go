@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("XT_SET", "value")
+	t.Setenv("XT_EMPTY", "")
+	t.Setenv("XT_NAME", "XT_SET")
+	os.Unsetenv("XT_UNSET")
+
+	tests := []struct {
+		input string
+		want  string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{input: "plain text", want: "plain text"},
+		{input: "$XT_SET and ${XT_SET}", want: "value and value"},
+		{input: "${XT_EMPTY}", want: ""},
+		{input: "$XT_UNSET", err: "missing required environment variables: XT_UNSET"},
+		{input: "${XT_UNSET} ${XT_UNSET2}", err: "XT_UNSET, XT_UNSET2"},
+
+		{input: "${XT_SET:-default}", want: "value"},
+		{input: "${XT_EMPTY:-default}", want: "default"},
+		{input: "${XT_UNSET:-default}", want: "default"},
+		{input: "${XT_SET-default}", want: "value"},
+		{input: "${XT_EMPTY-default}", want: ""},
+		{input: "${XT_UNSET-default}", want: "default"},
+		{input: "${XT_UNSET:-}", want: ""},
+
+		{input: "${XT_SET:?needed}", want: "value"},
+		{input: "${XT_EMPTY:?needed}", err: "required variable XT_EMPTY: needed"},
+		{input: "${XT_UNSET:?needed}", err: "required variable XT_UNSET: needed"},
+		{input: "${XT_EMPTY?needed}", want: ""},
+		{input: "${XT_UNSET?needed}", err: "required variable XT_UNSET: needed"},
+		{input: "${XT_UNSET?}", err: "required variable XT_UNSET: is not set"},
+		{input: "${XT_EMPTY:?}", err: "required variable XT_EMPTY: is empty"},
+
+		{input: "${XT_SET:+alt}", want: "alt"},
+		{input: "${XT_EMPTY:+alt}", want: ""},
+		{input: "${XT_UNSET:+alt}", want: ""},
+		{input: "${XT_SET+alt}", want: "alt"},
+		{input: "${XT_EMPTY+alt}", want: "alt"},
+		{input: "${XT_UNSET+alt}", want: ""},
+
+		{input: "$$XT_SET", want: "$$XT_SET"},
+		{input: "cost: $$5 and $", want: "cost: $$5 and $"},
+		{input: "$1 $-", want: "$1 $-"},
+
+		{input: "${XT_UNSET:-${XT_SET}}", want: "value"},
+		{input: "${XT_UNSET:-${XT_UNSET2:-deep}}", want: "deep"},
+		{input: "${XT_SET:+[${XT_SET}]}", want: "[value]"},
+		{input: "${XT_UNSET:-$XT_NAME}", want: "XT_SET"},
+		{input: "${XT_UNSET:-${XT_UNSET2}}", err: "missing required environment variables: XT_UNSET2"},
+		{input: "${XT_SET:-${XT_UNSET2}}", want: "value"},
+
+		{input: "${XT_SET", err: "unclosed ${"},
+		{input: "${}", err: "invalid interpolation format"},
+		{input: "${1X}", err: "invalid interpolation format"},
+		{input: "${XT_SET:}", err: "invalid interpolation format"},
+		{input: "${XT_SET/a/b}", err: "invalid interpolation format"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := interpolateEnv(test.input)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("interpolateEnv(%q) error = %v, want one containing %q", test.input, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("interpolateEnv(%q): %v", test.input, err)
+			}
+			if got != test.want {
+				t.Errorf("interpolateEnv(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
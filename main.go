@@ -8,7 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -55,8 +55,8 @@ echo "Docker installation completed successfully."
 const xDockerInstallScript = `#!/bin/bash
 set -e
 
-# Install Go 1.20.1
-GO_VERSION="1.20.1"
+# Install Go 1.22.12
+GO_VERSION="1.22.12"
 wget https://golang.org/dl/go${GO_VERSION}.linux-amd64.tar.gz
 sudo tar -C /usr/local -xzf go${GO_VERSION}.linux-amd64.tar.gz
 rm go${GO_VERSION}.linux-amd64.tar.gz
@@ -112,8 +112,8 @@ sudo usermod -aG docker ubuntu
 # Use sudo to run newgrp, which will exit immediately
 sudo -u ubuntu newgrp docker
 
-# Install Go 1.20.1
-GO_VERSION="1.20.1"
+# Install Go 1.22.12
+GO_VERSION="1.22.12"
 wget https://golang.org/dl/go${GO_VERSION}.linux-amd64.tar.gz
 sudo tar -C /usr/local -xzf go${GO_VERSION}.linux-amd64.tar.gz
 rm go${GO_VERSION}.linux-amd64.tar.gz
@@ -144,31 +144,65 @@ echo "Installation completed successfully."
 `
 type XDockerConfig struct {
 	Version  string                 `yaml:"version,omitempty"`
+	Name     string                 `yaml:"name,omitempty"`
+	Include  []interface{}          `yaml:"include,omitempty"`
 	Services map[string]interface{} `yaml:"services"`
 	Networks map[string]interface{} `yaml:"networks,omitempty"`
-	Extend   string                 `yaml:"extend,omitempty"`
+	Volumes  map[string]interface{} `yaml:"volumes,omitempty"`
+	Secrets  map[string]interface{} `yaml:"secrets,omitempty"`
+	Configs  map[string]interface{} `yaml:"configs,omitempty"`
+	Extend   extendList             `yaml:"extend,omitempty"`
 	Args     string                 `yaml:"args,omitempty"`
 	FileName string 				`yaml:"filename,omitempty"`
+	// Extra holds every other top-level key (x-* extension fields and
+	// anything newer compose versions add) so it survives a round-trip.
+	Extra    map[string]interface{} `yaml:",inline"`
+	// sources are the files merged into the config as they were written,
+	// the one that wins the merge first
+	sources  []configSource
 }
 type Extension struct {
 	Name      string               `yaml:"name"`
+	// Description is shown in errors about the extension's usage
+	Description string             `yaml:"description"`
 	Required  bool                 `yaml:"required"`
 	Path      string               `yaml:"path"`
 	Arguments map[string]Argument  `yaml:"arguments"`
 	Generate  string               `yaml:"generate"`
+	// Trusted extensions run with the full Lua and JavaScript runtime
+	Trusted   bool                 `yaml:"trusted"`
+	// Merge sets how generated keys are merged into the service, per
+	// dotted key path: append, prepend or replace
+	Merge     map[string]string    `yaml:"merge"`
+	// Priority orders extensions: lower values run first
+	Priority  int                  `yaml:"priority"`
+	// After lists extensions that must run before this one
+	After     []string             `yaml:"after"`
+	// Hooks are scripts or shell commands run at points of `up` and
+	// `down`, by event
+	Hooks     map[string]string    `yaml:"hooks"`
+	// Source is the file the extension was loaded from
+	Source    string               `yaml:"-"`
 }
 
 type Argument struct {
 	Type        string `yaml:"type"`
 	Description string `yaml:"description"`
 	Required    bool   `yaml:"required"`
-	Default     string `yaml:"default,omitempty"`
+	Default     interface{} `yaml:"default,omitempty"`
 
 }
 
 var extensions map[string]Extension
 
+// xdockerVersion is the version of xdocker, checked against the version
+// extension bundles require.
+const xdockerVersion = "1.0.0"
+
 const (
+	// localExtensionsDir holds the project's own extensions, which take
+	// precedence over all others
+	localExtensionsDir = "./extensions"
 	defaultGlobalExtensionsDir = "/usr/local/share/xdocker/extensions"
 	defaultGlobalServicesDir = "/usr/local/share/xdocker/services"
 )
@@ -177,6 +211,11 @@ var (
 	extensionsDir string
 	servicesDir string
 
+	// xdockerEnv is the environment selected with --env or XDOCKER_ENV
+	xdockerEnv string
+	// lenientExpressions keeps failing expressions in the output instead of
+	// aborting
+	lenientExpressions bool
 )
 
 func main() {
@@ -199,6 +238,19 @@ func main() {
     removeVolumeCmd := flag.NewFlagSet("remove-volume", flag.ExitOnError)
     updateVolumeCmd := flag.NewFlagSet("update-volume", flag.ExitOnError)
 
+	// Edit command flags: write into the file that defines the service or key
+	// instead of adding an override to the file named by -f
+	inParentUsage := "Edit the extended file that defines the service instead of overriding it"
+	removeInParent := removeServiceCmd.Bool("in-parent", false, inParentUsage)
+	skipInParent := skipServiceCmd.Bool("in-parent", false, inParentUsage)
+	unskipInParent := unskipServiceCmd.Bool("in-parent", false, inParentUsage)
+	addPortInParent := addPortCmd.Bool("in-parent", false, inParentUsage)
+	removePortInParent := removePortCmd.Bool("in-parent", false, inParentUsage)
+	updatePortInParent := updatePortCmd.Bool("in-parent", false, inParentUsage)
+	addVolumeInParent := addVolumeCmd.Bool("in-parent", false, inParentUsage)
+	removeVolumeInParent := removeVolumeCmd.Bool("in-parent", false, inParentUsage)
+	updateVolumeInParent := updateVolumeCmd.Bool("in-parent", false, inParentUsage)
+
 	// Install command flags
 	remoteHosts := installCmd.String("hosts", "", "Comma-separated list of user@host")
 	identityFile := installCmd.String("i", "", "Path to identity file")
@@ -217,41 +269,50 @@ func main() {
 	upLocalhost := upCmd.Bool("localhost", false, "Use localhost for exposed ports")
     upExclude := upCmd.String("exclude", "", "Comma-separated list of services to exclude from IP binding")
     upGlobal := upCmd.String("global", "", "Comma-separated list of services to bind to 0.0.0.0")
+	upLenient := upCmd.Bool("lenient", false, "Warn about failing expressions and keep them as-is instead of aborting")
+	upEnv := upCmd.String("env", os.Getenv("XDOCKER_ENV"), "Environment to layer on top of the compose file (can also be set via XDOCKER_ENV env var)")
+	upTrust := upCmd.Bool("trust", false, "Run expressions and extensions with the full Lua and JavaScript runtime, without sandbox limits")
+	upLuaLibs := upCmd.String("lua-libs", defaultLuaLibraries, "Comma-separated list of Lua libraries available to untrusted scripts")
+	upScriptTimeout := upCmd.Duration("script-timeout", scriptTimeout, "Time limit for each untrusted expression or extension")
 
 	// Down command flags
 	downKeepOrphans := downCmd.Bool("keep-orphans", false, "Keep containers for services not defined in the compose file")
 	downDry := downCmd.Bool("dry", false, "Only generate the docker-compose file without stopping containers")
+	downLenient := downCmd.Bool("lenient", false, "Warn about failing expressions and keep them as-is instead of aborting")
+	downEnv := downCmd.String("env", os.Getenv("XDOCKER_ENV"), "Environment to layer on top of the compose file (can also be set via XDOCKER_ENV env var)")
+	downTrust := downCmd.Bool("trust", false, "Run expressions and extensions with the full Lua and JavaScript runtime, without sandbox limits")
+	downLuaLibs := downCmd.String("lua-libs", defaultLuaLibraries, "Comma-separated list of Lua libraries available to untrusted scripts")
+	downScriptTimeout := downCmd.Duration("script-timeout", scriptTimeout, "Time limit for each untrusted expression or extension")
 
 	// Global flag
 	composeFile := flag.String("f", "xdocker-compose.yml", "Path to xdocker compose file")
 
-	// extensionsDir = defaultGlobalExtensionsDir
 	flag.StringVar(&extensionsDir, "extension-dir", "", "Custom extensions directory")
 	flag.StringVar(&servicesDir, "services-dir", defaultGlobalServicesDir, "Custom services directory")
 
 	flag.Parse()
-	if extensionsDir == "" {
-		extensionsDir = defaultGlobalExtensionsDir
-	}
 
-	// if extensionsDir does not exist, see if ./extensions exists and use that, if not, error out 
-	if _, err := os.Stat(extensionsDir); os.IsNotExist(err) {
-		if _, err := os.Stat("./extensions"); !os.IsNotExist(err) {
-			extensionsDir = "./extensions"
-		} else {
+	// Extension directories that do not exist are skipped, except for one
+	// given explicitly
+	if extensionsDir != "" {
+		if _, err := os.Stat(extensionsDir); os.IsNotExist(err) {
 			fmt.Fprintf(os.Stderr, "Extensions directory %s does not exist\n", extensionsDir)
 			os.Exit(1)
 		}
 	}
 
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'install', 'up', 'down', 'ps', 'iexec', or 'exec' subcommands")
+		fmt.Println("Expected 'install', 'up', 'down', 'ps', 'iexec', 'exec', 'extensions', or 'version' subcommands")
 		os.Exit(1)
 	}
 
-	if err := loadExtensions(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading extensions: %v\n", err)
-		os.Exit(1)
+	// The extensions command loads the extensions itself, so it can report
+	// on broken ones
+	if os.Args[1] != "extensions" && os.Args[1] != "version" {
+		if err := loadExtensions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading extensions: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 		var err error
@@ -265,13 +326,17 @@ func main() {
 		err = run("install", *composeFile, *remoteHosts, *identityFile, false, false, false, nil, *onlyDocker, *onlyXDocker, false, false, false, tailscaleAuthKey, "", "")
 	case "up":
 		upCmd.Parse(os.Args[2:])
+		xdockerEnv = *upEnv
+		// The sandbox can only be relaxed on the command line, not by the
+		// args of the compose file it protects against
+		trustScripts, luaLibraries, scriptTimeout = *upTrust, *upLuaLibs, *upScriptTimeout
 		var config *XDockerConfig
 		config, err = readAndMergeConfigs(*composeFile)
-		config.FileName = *composeFile
 		if err != nil {
-			fmt.Fprintf(os.Stderr,"error reading xdocker file: %v", err)
+			fmt.Fprintf(os.Stderr,"error reading xdocker file: %v\n", err)
 			os.Exit(1)
 		}
+		config.FileName = *composeFile
 
 		// Parse additional arguments from the config
 		var configArgs []string
@@ -285,10 +350,23 @@ func main() {
 
 		// Process the merged arguments
 		upCmd.Parse(allArgs)
+		xdockerEnv = *upEnv
+		lenientExpressions = *upLenient
+		if err := validateLuaLibraries(luaLibraries); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
 		err = run("up", *composeFile, "", "", *upDetach, !*upKeepOrphans, !*upNoBuild, upCmd.Args(), false, false, *upDry, *upTailscaleIP, *upLocalhost, "", *upExclude, *upGlobal)
 	case "down":
 		downCmd.Parse(os.Args[2:])
+		xdockerEnv = *downEnv
+		lenientExpressions = *downLenient
+		trustScripts, luaLibraries, scriptTimeout = *downTrust, *downLuaLibs, *downScriptTimeout
+		if err := validateLuaLibraries(luaLibraries); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
 		err = run("down", *composeFile, "", "", false, !*downKeepOrphans, false, downCmd.Args(), false, false, *downDry, false, false, "", "", "")
 	case "ps":
@@ -313,58 +391,64 @@ func main() {
         err = addServices(*composeFile, addServiceCmd.Args())
     case "remove":
         removeServiceCmd.Parse(os.Args[2:])
-        err = removeServices(*composeFile, removeServiceCmd.Args())
+        err = removeServices(*composeFile, removeServiceCmd.Args(), *removeInParent)
     case "skip":
         skipServiceCmd.Parse(os.Args[2:])
-        err = skipServices(*composeFile, skipServiceCmd.Args())
+        err = skipServices(*composeFile, skipServiceCmd.Args(), *skipInParent)
     case "unskip":
         unskipServiceCmd.Parse(os.Args[2:])
-        err = unskipServices(*composeFile, unskipServiceCmd.Args())
+        err = unskipServices(*composeFile, unskipServiceCmd.Args(), *unskipInParent)
 	case "add-port":
         addPortCmd.Parse(os.Args[2:])
         if addPortCmd.NArg() != 2 {
-            fmt.Println("Usage: xdocker add-port <service> <port>")
+            fmt.Println("Usage: xdocker add-port [--in-parent] <service> <port>")
             os.Exit(1)
         }
-        err = addPort(*composeFile, addPortCmd.Arg(0), addPortCmd.Arg(1))
+        err = addPort(*composeFile, addPortCmd.Arg(0), addPortCmd.Arg(1), *addPortInParent)
     case "remove-port":
         removePortCmd.Parse(os.Args[2:])
         if removePortCmd.NArg() != 1 {
-            fmt.Println("Usage: xdocker remove-port <port>")
+            fmt.Println("Usage: xdocker remove-port [--in-parent] <port>")
             os.Exit(1)
         }
-        err = removePort(*composeFile, removePortCmd.Arg(0))
+        err = removePort(*composeFile, removePortCmd.Arg(0), *removePortInParent)
     case "update-port":
         updatePortCmd.Parse(os.Args[2:])
         if updatePortCmd.NArg() != 2 {
-            fmt.Println("Usage: xdocker update-port <old-port> <new-port>")
+            fmt.Println("Usage: xdocker update-port [--in-parent] <old-port> <new-port>")
             os.Exit(1)
         }
-        err = updatePort(*composeFile, updatePortCmd.Arg(0), updatePortCmd.Arg(1))
+        err = updatePort(*composeFile, updatePortCmd.Arg(0), updatePortCmd.Arg(1), *updatePortInParent)
     case "add-volume":
         addVolumeCmd.Parse(os.Args[2:])
         if addVolumeCmd.NArg() != 2 {
-            fmt.Println("Usage: xdocker add-volume <service> <volume>")
+            fmt.Println("Usage: xdocker add-volume [--in-parent] <service> <volume>")
             os.Exit(1)
         }
-        err = addVolume(*composeFile, addVolumeCmd.Arg(0), addVolumeCmd.Arg(1))
+        err = addVolume(*composeFile, addVolumeCmd.Arg(0), addVolumeCmd.Arg(1), *addVolumeInParent)
     case "remove-volume":
         removeVolumeCmd.Parse(os.Args[2:])
         if removeVolumeCmd.NArg() != 2 {
-            fmt.Println("Usage: xdocker remove-volume <service> <volume>")
+            fmt.Println("Usage: xdocker remove-volume [--in-parent] <service> <volume>")
             os.Exit(1)
         }
-        err = removeVolume(*composeFile, removeVolumeCmd.Arg(0), removeVolumeCmd.Arg(1))
+        err = removeVolume(*composeFile, removeVolumeCmd.Arg(0), removeVolumeCmd.Arg(1), *removeVolumeInParent)
     case "update-volume":
         updateVolumeCmd.Parse(os.Args[2:])
         if updateVolumeCmd.NArg() != 3 {
-            fmt.Println("Usage: xdocker update-volume <service> <old-volume> <new-volume>")
+            fmt.Println("Usage: xdocker update-volume [--in-parent] <service> <old-volume> <new-volume>")
             os.Exit(1)
         }
-        err = updateVolume(*composeFile, updateVolumeCmd.Arg(0), updateVolumeCmd.Arg(1), updateVolumeCmd.Arg(2))
+        err = updateVolume(*composeFile, updateVolumeCmd.Arg(0), updateVolumeCmd.Arg(1), updateVolumeCmd.Arg(2), *updateVolumeInParent)
+
+	case "extensions":
+		err = runExtensionsCommand(os.Args[2:])
+
+	case "version":
+		fmt.Printf("xdocker %s\n", xdockerVersion)
 
 	default:
-		fmt.Println("Expected 'install', 'up', 'down', 'ps', 'iexec', or 'exec' subcommands")
+		fmt.Println("Expected 'install', 'up', 'down', 'ps', 'iexec', 'exec', 'extensions', or 'version' subcommands")
 		os.Exit(1)
 	}
 
@@ -509,30 +593,50 @@ func runDockerCompose(args ...string) error {
 	return nil
 }
 
-func processXDockerFile(inputFile string, tailscaleIP, localhost bool, exclude, global string) (string, error) {
-	// Load .env file
-	envFile := filepath.Join(filepath.Dir(inputFile), ".env")
-	err := godotenv.Load(envFile)
-	if err != nil && !os.IsNotExist(err) {
-		return "", fmt.Errorf("error loading .env file: %v", err)
+func processXDockerFile(inputFile string, tailscaleIP, localhost bool, exclude, global string) (string, *lifecycle, error) {
+	// Load .env and .env.<environment> files
+	err := loadEnvFiles(filepath.Dir(inputFile), xdockerEnv)
+	if err != nil {
+		return "", nil, err
 	}
 
 	config, err := readAndMergeConfigs(inputFile)
-	config.FileName = inputFile
 	if err != nil {
-		return "", fmt.Errorf("error processing xdocker files: %v", err)
+		return "", nil, fmt.Errorf("error processing xdocker files: %v", err)
 	}
+	config.FileName = inputFile
 
 	// Resolve all environment variables and expressions in the config
-	err = resolveAllEnvVariablesAndExpressions(config)
+	scripts, err := resolveAllEnvVariablesAndExpressions(config)
+	if err != nil {
+		return "", nil, fmt.Errorf("error resolving environment variables and expressions: %v", err)
+	}
+
+	// Check extension keys and arguments before any extension runs
+	err = validateCustomInstructions(config)
 	if err != nil {
-		return "", fmt.Errorf("error resolving environment variables and expressions: %v", err)
+		return "", nil, err
+	}
+
+	outputName := inputFile
+	if xdockerEnv != "" {
+		outputName = environmentFile(inputFile, xdockerEnv)
+	}
+	outputFile := fmt.Sprintf("docker-compose-%s.yml", filepath.Base(outputName))
+
+	// Pick the hooks to run while the extension keys are still there
+	hooks, err := newLifecycle(scripts, outputFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := hooks.run("pre-generate"); err != nil {
+		return "", nil, err
 	}
 
 	// Process custom instructions here
-	err = processCustomInstructions(config)
+	err = processCustomInstructions(scripts)
 	if err != nil {
-		return "", fmt.Errorf("error processing custom instructions: %v", err)
+		return "", nil, fmt.Errorf("error processing custom instructions: %v", err)
 	}
 
 	config.Version = ""
@@ -542,22 +646,66 @@ func processXDockerFile(inputFile string, tailscaleIP, localhost bool, exclude,
 	if tailscaleIP || localhost {
         err = modifyPortMappings(config, tailscaleIP, exclude, global)
 		if err != nil {
-			return "", fmt.Errorf("error modifying port mappings: %v", err)
+			return "", nil, fmt.Errorf("error modifying port mappings: %v", err)
 		}
 	}
 
-	outputFile := fmt.Sprintf("docker-compose-%s.yml", filepath.Base(inputFile))
 	outputData, err := customMarshal(config)
 	if err != nil {
-		return "", fmt.Errorf("error generating docker-compose file: %v", err)
+		return "", nil, fmt.Errorf("error generating docker-compose file: %v", err)
 	}
 
 	err = ioutil.WriteFile(outputFile, outputData, 0644)
 	if err != nil {
-		return "", fmt.Errorf("error writing docker-compose file: %v", err)
+		return "", nil, fmt.Errorf("error writing docker-compose file: %v", err)
+	}
+
+	if err := hooks.run("post-generate"); err != nil {
+		return "", nil, err
+	}
+
+	return outputFile, hooks, nil
+}
+
+// loadEnvFiles loads .env and then .env.<environment> from dir into the
+// process environment. Values from the environment specific file win over
+// .env, and variables that are already set are never overwritten.
+func loadEnvFiles(dir, environment string) error {
+	files := []string{filepath.Join(dir, ".env")}
+	if environment != "" {
+		files = append(files, filepath.Join(dir, ".env."+environment))
+	}
+
+	values := make(map[string]string)
+	for _, file := range files {
+		fileValues, err := godotenv.Read(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("error loading %s file: %v", filepath.Base(file), err)
+		}
+		for key, value := range fileValues {
+			values[key] = value
+		}
+	}
+	if environment != "" {
+		values["XDOCKER_ENV"] = environment
+	}
+
+	for key, value := range values {
+		if _, exists := os.LookupEnv(key); !exists {
+			os.Setenv(key, value)
+		}
 	}
+	return nil
+}
 
-	return outputFile, nil
+// environmentFile returns the per-environment variant of a compose file,
+// e.g. xdocker-compose.staging.yml for xdocker-compose.yml.
+func environmentFile(inputFile, environment string) string {
+	ext := filepath.Ext(inputFile)
+	return strings.TrimSuffix(inputFile, ext) + "." + environment + ext
 }
 
 func modifyPortMappings(config *XDockerConfig, useTailscale bool, exclude, global string) error {
@@ -576,11 +724,23 @@ func modifyPortMappings(config *XDockerConfig, useTailscale bool, exclude, globa
     excludedServices := strings.Split(exclude, ",")
     globalServices := strings.Split(global, ",")
 
-    for serviceName, serviceConfig := range config.Services {
-        service := serviceConfig.(map[interface{}]interface{})
+    serviceNames := make([]string, 0, len(config.Services))
+    for serviceName := range config.Services {
+        serviceNames = append(serviceNames, serviceName)
+    }
+    sort.Strings(serviceNames)
+
+    for _, serviceName := range serviceNames {
+        service, ok := config.Services[serviceName].(map[string]interface{})
+        if !ok {
+            continue
+        }
         if ports, ok := service["ports"].([]interface{}); ok {
             for i, port := range ports {
-                portStr := port.(string)
+                portStr, ok := port.(string)
+                if !ok {
+                    continue
+                }
                 parts := strings.Split(portStr, ":")
 
                 // Check if the service should be excluded
@@ -589,14 +749,15 @@ func modifyPortMappings(config *XDockerConfig, useTailscale bool, exclude, globa
                 }
 
                 // Check if the service should be bound to 0.0.0.0
+                serviceIP := ip
                 if contains(globalServices, serviceName) {
-                    ip = "0.0.0.0"
+                    serviceIP = "0.0.0.0"
                 }
 
                 if len(parts) == 2 {
-                    ports[i] = fmt.Sprintf("%s:%s:%s", ip, parts[0], parts[1])
+                    ports[i] = fmt.Sprintf("%s:%s:%s", serviceIP, parts[0], parts[1])
                 } else if len(parts) == 3 {
-                    ports[i] = fmt.Sprintf("%s:%s:%s", ip, parts[1], parts[2])
+                    ports[i] = fmt.Sprintf("%s:%s:%s", serviceIP, parts[1], parts[2])
                 }
             }
             service["ports"] = ports
@@ -617,17 +778,52 @@ func contains(slice []string, item string) bool {
 
 
 
-func resolveAllEnvVariablesAndExpressions(config *XDockerConfig) error {
-    for serviceName, serviceConfig := range config.Services {
-        service, ok := serviceConfig.(map[string]interface{})
-        if !ok {
-            return fmt.Errorf("expected map[string]interface{} for service %s, got %T", serviceName, serviceConfig)
-        }
-        err := resolveEnvVariablesAndExpressionsInMap(service)
+// resolveAllEnvVariablesAndExpressions resolves config in place and returns
+// the script context its expressions ran in, for the extensions and hooks.
+func resolveAllEnvVariablesAndExpressions(config *XDockerConfig) (*scriptContext, error) {
+    ctx, err := newScriptContext(config)
+    if err != nil && config.FileName != "" {
+        return nil, fmt.Errorf("%s: %v", config.FileName, err)
+    }
+    if err != nil {
+        return nil, err
+    }
+    // Errors in values name the file that defines them themselves
+    return ctx, resolveEnvVariablesAndExpressionsInConfig(ctx)
+}
+
+func resolveEnvVariablesAndExpressionsInConfig(ctx *scriptContext) error {
+    config := ctx.config
+    if config.Name != "" {
+        name, err := resolveEnvVariablesAndExpressionsInString(ctx, config.Name, []string{"name"})
         if err != nil {
-            return fmt.Errorf("error in service %s: %v", serviceName, err)
+            return err
+        }
+        config.Name = name
+    }
+    if err := resolveEnvVariablesAndExpressionsInSlice(ctx, config.Include, []string{"include"}); err != nil {
+        return err
+    }
+
+    sections := []struct {
+        name    string
+        entries map[string]interface{}
+    }{
+        {"services", config.Services},
+        {"networks", config.Networks},
+        {"volumes", config.Volumes},
+        {"secrets", config.Secrets},
+        {"configs", config.Configs},
+        {"", config.Extra},
+    }
+    for _, section := range sections {
+        var path []string
+        if section.name != "" {
+            path = []string{section.name}
+        }
+        if err := resolveEnvVariablesAndExpressionsInMap(ctx, section.entries, path); err != nil {
+            return err
         }
-        config.Services[serviceName] = service
     }
     return nil
 }
@@ -639,273 +835,476 @@ func getTailscaleIP() (string, error) {
 	}
 	return strings.TrimSpace(string(output)), nil
 }
-func resolveEnvVariablesAndExpressionsInMap(m map[string]interface{}) error {
-    for key, value := range m {
-        switch v := value.(type) {
-        case string:
-            resolved, err := resolveEnvVariablesAndExpressionsInString(v)
-            if err != nil {
-                return fmt.Errorf("error resolving value for key '%v': %v", key, err)
-            }
-            m[key] = resolved
-        case map[string]interface{}:
-            err := resolveEnvVariablesAndExpressionsInMap(v)
-            if err != nil {
-                return err
-            }
-        case []interface{}:
-            err := resolveEnvVariablesAndExpressionsInSlice(v)
-            if err != nil {
-                return err
+func resolveEnvVariablesAndExpressionsInMap(ctx *scriptContext, m map[string]interface{}, path []string) error {
+    // Expressions share one runtime and may have side effects, so they are
+    // evaluated in a fixed order
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        keyPath := append(path[:len(path):len(path)], key)
+        resolved, err := resolveEnvVariablesAndExpressionsInValue(ctx, m[key], keyPath)
+        if err != nil {
+            return err
+        }
+
+        // Keys such as label names may contain references too
+        resolvedKey, err := resolveEnvVariablesAndExpressionsInString(ctx, key, keyPath)
+        if err != nil {
+            return err
+        }
+        if resolvedKey != key {
+            if _, exists := m[resolvedKey]; exists {
+                return fmt.Errorf("%s: key resolves to '%v', which is already defined", describeSource(ctx.config, keyPath, key), resolvedKey)
             }
+            delete(m, key)
         }
+        m[resolvedKey] = resolved
     }
     return nil
 }
-func resolveEnvVariablesAndExpressionsInSlice(s []interface{}) error {
+func resolveEnvVariablesAndExpressionsInSlice(ctx *scriptContext, s []interface{}, path []string) error {
     for i, value := range s {
-        switch v := value.(type) {
-        case string:
-            resolved, err := resolveEnvVariablesAndExpressionsInString(v)
-            if err != nil {
-                return fmt.Errorf("error resolving value at index %d: %v", i, err)
-            }
-            s[i] = resolved
-        case map[string]interface{}:
-            err := resolveEnvVariablesAndExpressionsInMap(v)
-            if err != nil {
-                return err
-            }
-        case []interface{}:
-            err := resolveEnvVariablesAndExpressionsInSlice(v)
-            if err != nil {
-                return err
-            }
+        resolved, err := resolveEnvVariablesAndExpressionsInValue(ctx, value, append(path[:len(path):len(path)], strconv.Itoa(i)))
+        if err != nil {
+            return err
         }
+        s[i] = resolved
     }
     return nil
 }
-func evaluateLuaExpression(expr string) (string, error) {
-    l := lua.NewState()
-    lua.OpenLibraries(l)
+func resolveEnvVariablesAndExpressionsInValue(ctx *scriptContext, value interface{}, path []string) (interface{}, error) {
+    switch v := value.(type) {
+    case string:
+        return resolveEnvVariablesAndExpressionsInScalar(ctx, v, path)
+    case map[string]interface{}:
+        return v, resolveEnvVariablesAndExpressionsInMap(ctx, v, path)
+    case []interface{}:
+        return v, resolveEnvVariablesAndExpressionsInSlice(ctx, v, path)
+    }
+    return value, nil
+}
 
-    if err := lua.DoString(l, "return "+expr); err != nil {
-        return "", err
+// describeKeyPath names the place of a value in the document for error
+// messages, e.g. `service "web", key "environment.DB_HOST"`.
+func describeKeyPath(path []string) string {
+    if len(path) > 2 && path[0] == "services" {
+        return fmt.Sprintf("service %q, key %q", path[1], strings.Join(path[2:], "."))
     }
-    if l.Top() == 0 {
-        return "", fmt.Errorf("Lua expression did not return a value")
+    if len(path) == 2 && path[0] == "services" {
+        return fmt.Sprintf("service %q", path[1])
     }
-    result := lua.CheckString(l, -1)
-    l.Pop(1)
-    return result, nil
+    return fmt.Sprintf("key %q", strings.Join(path, "."))
 }
 
-func evaluateJSExpression(expr string) (string, error) {
-    vm := goja.New()
+// describeSource is describeKeyPath prefixed with the file that defines value
+// at path, which for values inherited through extend is not the -f file.
+func describeSource(config *XDockerConfig, path []string, value string) string {
+    file := config.sourceOf(path, value)
+    if file == "" {
+        return describeKeyPath(path)
+    }
+    return fmt.Sprintf("%s: %s", file, describeKeyPath(path))
+}
+func evaluateLuaExpression(ctx *scriptContext, expr string) (interface{}, error) {
+    l := ctx.lua
+    defer l.SetTop(0)
+
+    // A block that is not a single expression runs as a chunk of statements
+    // and returns its value explicitly
+    if err := lua.LoadString(l, "return "+expr); err != nil {
+        l.Pop(1)
+        if err := lua.LoadString(l, expr); err != nil {
+            return nil, err
+        }
+    }
+    stop := limitLua(l, false)
+    defer stop()
+    if err := l.ProtectedCall(0, lua.MultipleReturns, 0); err != nil {
+        return nil, err
+    }
+    if l.Top() == 0 {
+        return nil, fmt.Errorf("Lua expression did not return a value")
+    }
+    // Like an assignment, keep the first of several return values
+    return luaToGo(l, 1)
+}
 
-    // Wrap the expression in a function
-    wrappedExpr := fmt.Sprintf(`
-        (function() {
-            return %s;
-        })()
-    `, expr)
+func evaluateJSExpression(ctx *scriptContext, expr string) (interface{}, error) {
+    vm := ctx.js
+    stop := limitJS(vm, false)
+    defer stop()
+
+    // Wrap the expression in a function; a block that is not a single
+    // expression becomes the body of the function and returns its value
+    // explicitly
+    wrappedExpr := fmt.Sprintf("(function() {\nreturn (%s\n);\n})()", strings.TrimRight(strings.TrimSpace(expr), ";"))
+    if _, err := goja.Compile("", wrappedExpr, false); err != nil {
+        wrappedExpr = fmt.Sprintf("(function() {\n%s\n})()", expr)
+    }
 
     result, err := vm.RunString(wrappedExpr)
     if err != nil {
-        return "", err
-    }
-
-    if goja.IsUndefined(result) || goja.IsNull(result) {
-        return "", nil
+        return nil, err
     }
 
-    return result.String(), nil
+    return jsToGo(result)
+}
+func resolveEnvVariablesAndExpressionsInString(ctx *scriptContext, s string, path []string) (string, error) {
+	value, err := resolveEnvVariablesAndExpressionsInScalar(ctx, s, path)
+	if err != nil {
+		return "", err
+	}
+	return formatExpressionResult(value), nil
 }
-func resolveEnvVariablesAndExpressionsInString(s string) (string, error) {
+
+// resolveEnvVariablesAndExpressionsInScalar resolves a string value. A value
+// that consists of a single expression keeps the type the expression
+// evaluates to, so `replicas: "{{ 3 }}"` becomes an int and a Lua table or
+// JavaScript array a list; expressions embedded in text are rendered into it.
+//
+// A failing expression aborts with its location and source, unless
+// --lenient is given: then the error is printed and the expression is left
+// in the output as it was.
+func resolveEnvVariablesAndExpressionsInScalar(ctx *scriptContext, s string, path []string) (interface{}, error) {
+	where := describeSource(ctx.config, path, s)
+
 	// First, resolve environment variables
-	reEnv := regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
-	var missingVars []string
-	s = reEnv.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[1:] // Remove the leading $
-		if varName[0] == '{' {
-			varName = varName[1 : len(varName)-1] // Remove { and }
+	s, err := interpolateEnv(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", where, err)
+	}
+
+	tokens, err := scanExpressions(s)
+	if err != nil {
+		return s, reportExpressionError(fmt.Errorf("%s: %v", where, err))
+	}
+
+	var exprErr error
+	evaluate := func(token expressionToken) (interface{}, bool) {
+		result, err := evaluateExpression(ctx, token.lang, token.body, serviceOfPath(path))
+		if err == nil {
+			return result, true
 		}
-		if value, exists := os.LookupEnv(varName); exists {
-			return value
+		err = fmt.Errorf("%s: %s expression failed: %v\n  expression: %s", where, token.lang, err, token.text)
+		if exprErr == nil {
+			exprErr = reportExpressionError(err)
 		}
-		missingVars = append(missingVars, varName)
-		return match // Keep original for error reporting
-	})
+		return nil, false
+	}
 
-	if len(missingVars) > 0 {
-		return "", fmt.Errorf("missing required environment variables: %s", strings.Join(missingVars, ", "))
+	var expressions []expressionToken
+	blank := true
+	for _, token := range tokens {
+		if token.lang != "" {
+			expressions = append(expressions, token)
+		} else if strings.TrimSpace(token.text) != "" {
+			blank = false
+		}
+	}
+	if len(expressions) == 1 && blank {
+		if result, ok := evaluate(expressions[0]); ok {
+			return result, nil
+		}
+		return s, exprErr // Return original if evaluation fails
 	}
 
-	// Then, evaluate expressions for each language
-    languagePatterns := map[string]*regexp.Regexp{
-        "lua": regexp.MustCompile(`\{\{(.+?)\}\}`),
-        "js":  regexp.MustCompile(`\[\[(.+?)\]\]`),
-    }
-
-    for lang, pattern := range languagePatterns {
-        s = pattern.ReplaceAllStringFunc(s, func(match string) string {
-            var expr string
-            var result string
-            var err error
-
-            switch lang {
-            case "lua":
-                expr = match[2 : len(match)-2] // Remove {{ and }}
-                result, err = evaluateLuaExpression(expr)
-            case "js":
-                expr = match[2 : len(match)-2] // Remove [[ and ]]
-                result, err = evaluateJSExpression(expr)
-            }
+	// Then, evaluate the expressions embedded in the text
+	var b strings.Builder
+	for _, token := range tokens {
+		if token.lang == "" {
+			b.WriteString(token.text)
+			continue
+		}
+		result, ok := evaluate(token)
+		if !ok {
+			b.WriteString(token.text) // Keep original if evaluation fails
+			continue
+		}
+		b.WriteString(formatExpressionResult(result))
+	}
+	return b.String(), exprErr
+}
 
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "%s expression evaluation error: %s\n", lang, err)
-                return match // Return original if evaluation fails
-            }
-            return result
-        })
-    }
+// reportExpressionError returns err, or prints it as a warning and returns
+// nil with --lenient.
+func reportExpressionError(err error) error {
+	if !lenientExpressions {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	return nil
+}
 
-    return s, nil
+func evaluateExpression(ctx *scriptContext, lang, expr, service string) (interface{}, error) {
+	ctx.setService(service)
+	switch lang {
+	case "lua":
+		return evaluateLuaExpression(ctx, expr)
+	case "js":
+		return evaluateJSExpression(ctx, expr)
+	}
+	return nil, fmt.Errorf("unsupported language: %s", lang)
 }
 
 func mergeConfigs(parent, child *XDockerConfig) {
 	if child.Version == "" {
 		child.Version = parent.Version
 	}
-
-	for serviceName, serviceConfig := range parent.Services {
-		if _, exists := child.Services[serviceName]; !exists {
-			child.Services[serviceName] = serviceConfig
-		} else {
-			// Merge service configurations
-			parentService := serviceConfig.(map[string]interface {})
-			childService := child.Services[serviceName].(map[string]interface {})
-			for key, value := range parentService {
-				if _, exists := childService[key]; !exists {
-					childService[key] = value
-				}
-			}
-		}
+	if child.Name == "" {
+		child.Name = parent.Name
 	}
-	if child.Networks == nil {
-        child.Networks = make(map[string]interface{})
-    }
-    for networkName, networkConfig := range parent.Networks {
-        if _, exists := child.Networks[networkName]; !exists {
-            child.Networks[networkName] = networkConfig
-        }
-    }
+	if len(parent.Include) > 0 {
+		child.Include = append(append([]interface{}{}, parent.Include...), child.Include...)
+	}
+
+	child.Services = mergeSection(parent.Services, child.Services, listMergeStrategies)
+	child.Networks = mergeSection(parent.Networks, child.Networks, nil)
+	child.Volumes = mergeSection(parent.Volumes, child.Volumes, nil)
+	child.Secrets = mergeSection(parent.Secrets, child.Secrets, nil)
+	child.Configs = mergeSection(parent.Configs, child.Configs, nil)
+	child.Extra = mergeSection(parent.Extra, child.Extra, nil)
 
 	// Remove the 'extend' field as it's not valid in docker-compose
-	child.Extend = ""
+	child.Extend = nil
 }
 
+// mergeSection merges a top-level section (services, networks, volumes, ...)
+// of a parent config into the child. Entries defined on both sides are
+// deep-merged with mergeValuesWith, the child's values winning. strategies
+// are the list strategies of the section: listMergeStrategies for services,
+// none for the others, whose lists are concatenated.
+func mergeSection(parent, child map[string]interface{}, strategies map[string]string) map[string]interface{} {
+	if len(parent) == 0 {
+		return child
+	}
+	if child == nil {
+		child = make(map[string]interface{})
+	}
+	for name, parentValue := range parent {
+		childValue, exists := child[name]
+		if !exists || childValue == nil {
+			child[name] = parentValue
+			continue
+		}
+		child[name] = mergeValuesWith(parentValue, childValue, "", strategies)
+	}
+	return child
+}
+
+
+// extendList is the `extend` field: a single file or a list of files.
+type extendList []string
+
+func (e *extendList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = nil
+		if node.Value != "" {
+			*e = extendList{node.Value}
+		}
+		return nil
+	}
+	var files []string
+	if err := node.Decode(&files); err != nil {
+		return fmt.Errorf("extend must be a file name or a list of file names: %v", err)
+	}
+	*e = files
+	return nil
+}
 
-func readAndMergeConfigsRecursive(inputFile string, visited map[string]bool) (*XDockerConfig, error) {
-	if visited[inputFile] {
-		return nil, fmt.Errorf("circular dependency detected in file: %s", inputFile)
+// readAndMergeConfigsRecursive reads inputFile and every file it extends.
+// Files are appended to order depth-first, each after its parents and the
+// parents in the order they are listed. A file reached through several
+// parents (diamond inheritance) is read once, at its first position; visited
+// holds the current chain and only rejects real cycles.
+func readAndMergeConfigsRecursive(inputFile string, visited []string, configs map[string]*XDockerConfig, order *[]string) error {
+	inputFile = filepath.Clean(inputFile)
+	for i, file := range visited {
+		if file == inputFile {
+			chain := append(append([]string{}, visited[i:]...), inputFile)
+			return fmt.Errorf("circular dependency detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if _, ok := configs[inputFile]; ok {
+		return nil
 	}
-	visited[inputFile] = true
 
 	data, err := ioutil.ReadFile(inputFile)
 	if err != nil {
-		return nil, fmt.Errorf("error reading xdocker file %s: %v", inputFile, err)
+		return fmt.Errorf("error reading xdocker file %s: %v", inputFile, err)
 	}
 
 	var config XDockerConfig
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing xdocker file %s: %v", inputFile, err)
+		return fmt.Errorf("error parsing xdocker file %s: %v", inputFile, err)
 	}
+	// Keep the file as written too, merging changes config
+	source := configSource{file: inputFile}
+	if err := yaml.Unmarshal(data, &source.content); err != nil {
+		return fmt.Errorf("error parsing xdocker file %s: %v", inputFile, err)
+	}
+	config.sources = []configSource{source}
 
-	if config.Extend != "" {
-		extendFile := filepath.Join(filepath.Dir(inputFile), config.Extend)
-		parentConfig, err := readAndMergeConfigsRecursive(extendFile, visited)
-		if err != nil {
-			return nil, err
+	visited = append(visited[:len(visited):len(visited)], inputFile)
+	for _, extend := range config.Extend {
+		extendFile := filepath.Join(filepath.Dir(inputFile), extend)
+		if err := readAndMergeConfigsRecursive(extendFile, visited, configs, order); err != nil {
+			return err
 		}
-		mergeConfigs(parentConfig, &config)
 	}
 
-	return &config, nil
+	configs[inputFile] = &config
+	*order = append(*order, inputFile)
+	return nil
 }
+
+// readAndMergeConfigs reads inputFile with everything it extends and merges
+// the files in the order readAndMergeConfigsRecursive produced: with
+// `extend: [a.yml, b.yml]`, b.yml overrides a.yml and the file itself
+// overrides both. The file of the selected environment, if any, comes last.
 func readAndMergeConfigs(inputFile string) (*XDockerConfig, error) {
-	visited := make(map[string]bool)
-	return readAndMergeConfigsRecursive(inputFile, visited)
+	var order []string
+	configs := make(map[string]*XDockerConfig)
+	if err := readAndMergeConfigsRecursive(inputFile, nil, configs, &order); err != nil {
+		return nil, err
+	}
+	// The selected environment's file is layered on top of everything else
+	if xdockerEnv != "" {
+		overlay := environmentFile(inputFile, xdockerEnv)
+		if _, err := os.Stat(overlay); err == nil {
+			if err := readAndMergeConfigsRecursive(overlay, nil, configs, &order); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var merged *XDockerConfig
+	for _, file := range order {
+		config := configs[file]
+		if merged != nil {
+			mergeConfigs(merged, config)
+			config.sources = append(config.sources, merged.sources...)
+		}
+		merged = config
+	}
+	stripConfigMergeTags(merged)
+	return merged, nil
 }
 
 func addServices(composeFile string, services []string) error {
-    config, err := readAndMergeConfigs(composeFile)
+    doc, err := loadComposeDocument(composeFile)
     if err != nil {
         return err
     }
 
     for _, service := range services {
-        serviceConfig, err := readServiceConfig(service)
+        definition, err := readServiceDefinition(service)
         if err != nil {
             return err
         }
-        for name, def := range serviceConfig.Services {
-            config.Services[name] = def
+        for _, name := range definition.serviceNames() {
+            setMappingValue(doc.ensureSection("services"), name, mappingValue(definition.section("services"), name))
+            doc.touch("services", name)
+        }
+        // Named volumes, networks, secrets and configs the service relies on
+        // are added unless the compose file already defines them.
+        for _, section := range []string{"networks", "volumes", "secrets", "configs"} {
+            entries := definition.section(section)
+            for i := 0; entries != nil && i+1 < len(entries.Content); i += 2 {
+                name := entries.Content[i].Value
+                if mappingKey(doc.section(section), name) != nil {
+                    continue
+                }
+                setMappingValue(doc.ensureSection(section), name, entries.Content[i+1])
+                doc.touch(section, name)
+            }
         }
     }
 
-    return writeConfig(composeFile, config)
+    return doc.save()
 }
 
-func removeServices(composeFile string, services []string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func removeServices(composeFile string, services []string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
     for _, service := range services {
-        delete(config.Services, service)
+        docs := chain.docs[:1]
+        if inParent {
+            docs = chain.docs
+        }
+        for _, doc := range docs {
+            if deleteMappingKey(doc.section("services"), service) {
+                doc.touch("services", service)
+            }
+        }
+        // a service that is still inherited is removed with `!reset`
+        if chain.serviceOwner(service) != nil {
+            doc := chain.file()
+            setMappingValue(doc.ensureSection("services"), service, resetNode())
+            doc.touch("services", service)
+        }
     }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func skipServices(composeFile string, services []string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func skipServices(composeFile string, services []string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
     for _, service := range services {
-        if svc, ok := config.Services[service]; ok {
-            svcMap := svc.(map[interface{}]interface{})
-            svcMap["skip"] = true
-            config.Services[service] = svcMap
+        if chain.serviceOwner(service) == nil {
+            continue
+        }
+        doc, svc, err := chain.editService(service, inParent)
+        if err != nil {
+            return err
         }
+        setMappingValue(svc, "skip", boolNode(true))
+        doc.touch("services", service)
     }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func unskipServices(composeFile string, services []string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func unskipServices(composeFile string, services []string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
     for _, service := range services {
-        if svc, ok := config.Services[service]; ok {
-            svcMap := svc.(map[interface{}]interface{})
-            delete(svcMap, "skip")
-            config.Services[service] = svcMap
+        owner := chain.keyOwner(service, "skip")
+        if owner == nil {
+            continue
         }
+        if owner == chain.file() || inParent {
+            deleteMappingKey(owner.service(service), "skip")
+            owner.touch("services", service)
+            chain.pruneOverride(service)
+            continue
+        }
+        // skip is inherited, so it can only be dropped by an override
+        doc, svc, err := chain.editService(service, false)
+        if err != nil {
+            return err
+        }
+        setMappingValue(svc, "skip", resetNode())
+        doc.touch("services", service)
     }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func readServiceConfig(service string) (*XDockerConfig, error) {
+func readServiceDefinition(service string) (*composeDocument, error) {
     locations := []string{
         filepath.Join("services", service + ".yml"),
         filepath.Join(servicesDir, service + ".yml"),
@@ -915,36 +1314,13 @@ func readServiceConfig(service string) (*XDockerConfig, error) {
         locations = append(locations, filepath.Join(defaultGlobalServicesDir, service + ".yml"))
     }
 
-    var data []byte
-    var err error
-
     for _, location := range locations {
-        data, err = ioutil.ReadFile(location)
-        if err == nil {
-            break
+        if _, err := os.Stat(location); err == nil {
+            return loadComposeDocument(location)
         }
     }
 
-    if err != nil {
-        return nil, fmt.Errorf("service definition for %s not found: %v", service, err)
-    }
-
-    var config XDockerConfig
-    err = yaml.Unmarshal(data, &config)
-    if err != nil {
-        return nil, err
-    }
-
-    return &config, nil
-}
-
-func writeConfig(filename string, config *XDockerConfig) error {
-    data, err := yaml.Marshal(config)
-    if err != nil {
-        return err
-    }
-
-    return ioutil.WriteFile(filename, data, 0644)
+    return nil, fmt.Errorf("service definition for %s not found in %s", service, strings.Join(locations, ", "))
 }
 
 func run(command, composeFile, remoteHosts, identityFile string, detach, removeOrphans, build bool, services []string, onlyDocker, onlyXDocker, dry, tailscaleIP, localhost bool, tailscaleAuthKey, exclude, global string) error {
@@ -958,7 +1334,7 @@ func run(command, composeFile, remoteHosts, identityFile string, detach, removeO
 			remoteInstall(remoteHosts, identityFile, onlyDocker, onlyXDocker, tailscaleAuthKey)
 		}
 	case "up", "down":
-		dockerComposeFile, err := processXDockerFile(composeFile, tailscaleIP, localhost,  exclude, global)
+		dockerComposeFile, hooks, err := processXDockerFile(composeFile, tailscaleIP, localhost,  exclude, global)
 		if err != nil {
 			return fmt.Errorf("error processing xdocker file: %v", err)
 		}
@@ -968,6 +1344,10 @@ func run(command, composeFile, remoteHosts, identityFile string, detach, removeO
 			return nil
 		}
 
+		if err := hooks.run("pre-" + command); err != nil {
+			return err
+		}
+
 		args := []string{"-f", dockerComposeFile, command}
 		if command == "up" {
 			if detach {
@@ -986,6 +1366,8 @@ func run(command, composeFile, remoteHosts, identityFile string, detach, removeO
 		if err != nil {
 			return fmt.Errorf("error running docker-compose %s: %v", command, err)
 		}
+
+		return hooks.run("post-" + command)
 	}
 
 	return nil
@@ -1005,39 +1387,94 @@ func customMarshal(in interface{}) ([]byte, error) {
 }
 
 
+// extensionDirs returns the directories extensions are loaded from, highest
+// precedence first: the project's ./extensions, --extension-dir, the user's
+// $XDG_CONFIG_HOME/xdocker/extensions and the global directory.
+func extensionDirs() []string {
+    candidates := []string{localExtensionsDir}
+    if extensionsDir != "" {
+        candidates = append(candidates, extensionsDir)
+    }
+    if dir := userExtensionsDir(); dir != "" {
+        candidates = append(candidates, dir)
+    }
+    candidates = append(candidates, defaultGlobalExtensionsDir)
+
+    var dirs []string
+    seen := make(map[string]bool)
+    for _, dir := range candidates {
+        abs, err := filepath.Abs(dir)
+        if err != nil {
+            abs = dir
+        }
+        if !seen[abs] {
+            seen[abs] = true
+            dirs = append(dirs, dir)
+        }
+    }
+    return dirs
+}
+
+// userExtensionsDir returns the extensions directory of the user, or "" if
+// there is no home directory.
+func userExtensionsDir() string {
+    configHome := os.Getenv("XDG_CONFIG_HOME")
+    if configHome == "" {
+        home, err := os.UserHomeDir()
+        if err != nil {
+            return ""
+        }
+        configHome = filepath.Join(home, ".config")
+    }
+    return filepath.Join(configHome, "xdocker", "extensions")
+}
+
+// loadExtensions loads the extensions of all extension directories. An
+// extension of a directory with higher precedence shadows one with the same
+// name, or claiming the same path, in a directory with lower precedence; two
+// such extensions in the same directory are an error.
 func loadExtensions() error {
     extensions = make(map[string]Extension)
-    dirs := []string{extensionsDir}
-    
-    if extensionsDir != defaultGlobalExtensionsDir {
-        dirs = append(dirs, defaultGlobalExtensionsDir)
-    }
+    claims := make(map[string]Extension)
 
-    for _, dir := range dirs {
+    for _, dir := range extensionDirs() {
 		// check if dir exists, otherwise skip it; 
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			continue
 		}
 
-        files, err := ioutil.ReadDir(dir)
+        files, err := extensionFiles(dir)
         if err != nil {
             fmt.Fprintf(os.Stderr, "Warning: error reading extensions directory %s: %v\n", dir, err)
             continue
         }
-        for _, file := range files {
-            if filepath.Ext(file.Name()) == ".yml" {
-                filePath := filepath.Join(dir, file.Name())
-                data, err := ioutil.ReadFile(filePath)
-                if err != nil {
-                    return fmt.Errorf("error reading extension file %s: %v", file.Name(), err)
-                }
-                var ext Extension
-                err = yaml.Unmarshal(data, &ext)
-                if err != nil {
-                    return fmt.Errorf("error parsing extension file %s: %v", file.Name(), err)
-                }
-                extensions[ext.Name] = ext
+        names := make(map[string]string)
+        paths := make(map[string]string)
+        for _, filePath := range files {
+            ext, err := loadExtension(filePath)
+            if err != nil {
+                return err
+            }
+
+            if other, ok := names[ext.Name]; ok {
+                return fmt.Errorf("extension %s is defined twice: in %s and %s", ext.Name, other, filePath)
+            }
+            names[ext.Name] = filePath
+            if other, ok := paths[ext.Path]; ok && ext.Path != "" {
+                return fmt.Errorf("extensions in %s and %s both claim the path %s", other, filePath, ext.Path)
+            }
+            paths[ext.Path] = filePath
+
+            if existing, ok := extensions[ext.Name]; ok {
+                fmt.Fprintf(os.Stderr, "Warning: extension %s in %s is shadowed by %s\n", ext.Name, filePath, existing.Source)
+                continue
+            }
+            if existing, ok := claims[ext.Path]; ok && ext.Path != "" {
+                fmt.Fprintf(os.Stderr, "Warning: extension %s in %s is shadowed by %s (%s), which claims the same path %s\n", ext.Name, filePath, existing.Name, existing.Source, ext.Path)
+                continue
             }
+            claims[ext.Path] = ext
+            extensions[ext.Name] = ext
         }
     }
 	// print extensions for debugging; 
@@ -1045,175 +1482,254 @@ func loadExtensions() error {
     return nil
 }
 
-func processCustomInstructions(config *XDockerConfig) error {
-	for serviceName, serviceConfig := range config.Services {
-		service, ok := serviceConfig.(map[string]interface{})
-        if !ok {
-            return fmt.Errorf("expected map[string]interface{} for service %s, got %T", serviceName, serviceConfig)
+// extensionFiles returns the extension files in dir, and in the bundles
+// installed into it, leaving out their test fixtures.
+func extensionFiles(dir string) ([]string, error) {
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var paths []string
+    for _, file := range files {
+        if file.IsDir() {
+            // hidden directories hold bundles being installed
+            if strings.HasPrefix(file.Name(), ".") {
+                continue
+            }
+            bundleDir := filepath.Join(dir, file.Name())
+            if _, err := os.Stat(filepath.Join(bundleDir, bundleManifestName)); err != nil {
+                continue
+            }
+            bundleFiles, err := extensionFiles(bundleDir)
+            if err != nil {
+                return nil, err
+            }
+            paths = append(paths, bundleFiles...)
+            continue
+        }
+        fileExt := filepath.Ext(file.Name())
+        if fileExt != ".yml" && fileExt != ".yaml" || isExtensionTestFile(file.Name()) || file.Name() == bundleManifestName {
+            continue
         }
-		
-		for extName, ext := range extensions {
-			if strings.HasPrefix(ext.Path, "/$service/") {
-				key := strings.TrimPrefix(ext.Path, "/$service/")
-				if value, ok := service[key]; ok {
-					result, err := processExtension(ext, fmt.Sprintf("%v", value), config.FileName)
-					if err != nil {
-						return fmt.Errorf("error processing extension %s for service %s: %v", extName, serviceName, err)
-					}
-					delete(service, key)
-					if result != "" {
-						var resultMap map[string]interface{}
-						err = yaml.Unmarshal([]byte(result), &resultMap)
-						if err != nil {
-							return fmt.Errorf("error parsing extension result for %s: %v\nResult:\n%s", extName, err, result)
-						}
-						for k, v := range resultMap {
-							service[k] = v
-						}
-					}
+        paths = append(paths, filepath.Join(dir, file.Name()))
+    }
+    return paths, nil
+}
+
+// loadExtension reads and checks a single extension file. An extension
+// without a name is named after its file.
+func loadExtension(filePath string) (Extension, error) {
+    var ext Extension
+    data, err := ioutil.ReadFile(filePath)
+    if err != nil {
+        return ext, fmt.Errorf("error reading extension file %s: %v", filePath, err)
+    }
+    err = yaml.Unmarshal(data, &ext)
+    if err != nil {
+        return ext, fmt.Errorf("error parsing extension file %s: %v", filePath, err)
+    }
+    ext.Source = filePath
+    if ext.Name == "" {
+        ext.Name = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+    }
+    // Extensions that only have hooks need no path
+    if ext.Path != "" || ext.Generate != "" || len(ext.Hooks) == 0 {
+        if _, _, err := parseExtensionPath(ext.Path); err != nil {
+            return ext, fmt.Errorf("error in extension file %s: %v", filePath, err)
+        }
+    }
+    for event := range ext.Hooks {
+        if !isHookEvent(event) {
+            return ext, fmt.Errorf("error in extension file %s: unknown hook %q%s (hooks: %s)", filePath, event, didYouMean(event, hookEvents), strings.Join(hookEvents, ", "))
+        }
+    }
+    for key, mode := range ext.Merge {
+        if !extensionMergeModes[mode] {
+            return ext, fmt.Errorf("error in extension file %s: unknown merge mode %q for %s, expected append, prepend or replace", filePath, mode, key)
+        }
+    }
+    return ext, nil
+}
+
+// processCustomInstructions runs the extensions whose key appears in the
+// document, one extension after the other in the order of extensionOrder,
+// and merges their results into the map the key was found in. The scripts
+// run in ctx, after the expressions.
+func processCustomInstructions(ctx *scriptContext) error {
+	config := ctx.config
+	extNames, err := extensionOrder(extensions)
+	if err != nil {
+		return err
+	}
+
+	for _, extName := range extNames {
+		ext := extensions[extName]
+		if ext.Path == "" {
+			continue
+		}
+		segments, key, err := parseExtensionPath(ext.Path)
+		if err != nil {
+			return fmt.Errorf("extension %s: %v", extName, err)
+		}
+		root := configDocument(config)
+		for _, target := range findExtensionTargets(root, segments) {
+			value, ok := target.container[key]
+			if !ok {
+				continue
+			}
+			// The key of an extension with hooks only enables them
+			if strings.TrimSpace(ext.Generate) == "" {
+				delete(target.container, key)
+				if err := applyConfigDocument(config, root); err != nil {
+					return fmt.Errorf("error applying extension %s: %v", extName, err)
 				}
+				continue
+			}
+			result, err := processExtension(ctx, ext, value, serviceOfPath(target.path))
+			if err != nil {
+				return fmt.Errorf("error processing extension %s for %s: %v", extName, describeKeyPath(append(target.path, key)), err)
+			}
+			delete(target.container, key)
+			if err := addGeneratedSections(root, result, serviceOfPath(target.path)); err != nil {
+				return fmt.Errorf("error processing extension %s for %s: %v", extName, describeKeyPath(append(target.path, key)), err)
+			}
+			mergeExtensionResult(target.container, result, ext.Merge)
+
+			// Let the following scripts see the changes through xdocker.config()
+			if err := applyConfigDocument(config, root); err != nil {
+				return fmt.Errorf("error applying extension %s: %v", extName, err)
 			}
 		}
-		config.Services[serviceName] = service
 	}
 	return nil
 }
-func processExtension(ext Extension, value string, composeFileName string) (string, error) {
-    // Determine the language based on the delimiters
-    trimmedGenerate := strings.TrimSpace(ext.Generate)
-
-    // Determine the language based on the delimiters
-    var lang string
-    var expr string
-
-    if strings.HasPrefix(trimmedGenerate, "{{") && strings.HasSuffix(trimmedGenerate, "}}") {
-        lang = "lua"
-        expr = strings.TrimSpace(trimmedGenerate[2 : len(trimmedGenerate)-2])
-    } else if strings.HasPrefix(trimmedGenerate, "[[") && strings.HasSuffix(trimmedGenerate, "]]") {
-        lang = "js"
-        expr = strings.TrimSpace(trimmedGenerate[2 : len(trimmedGenerate)-2])
-    } else {
-        // If no delimiters are found, default to Lua for backward compatibility
-        lang = "lua"
-        expr = trimmedGenerate
+// processExtension runs the generate script of ext for a key in service, if
+// any, and returns the keys it produces. Scripts return a Lua table or
+// JavaScript object, or a YAML string.
+func processExtension(ctx *scriptContext, ext Extension, value interface{}, service string) (map[string]interface{}, error) {
+    args, err := bindExtensionArguments(ext, value)
+    if err != nil {
+        return nil, err
     }
 
+    lang, expr := extensionScript(ext)
+    ctx = ctx.runtimeFor(ext)
+    ctx.setService(service)
+
+    var result interface{}
     switch lang {
     case "lua":
-        return processLuaExtension(ext, value, composeFileName, expr)
+        result, err = processLuaExtension(ctx, args, expr)
     case "js":
-        return processJSExtension(ext, value, composeFileName, expr)
+        result, err = processJSExtension(ctx, args, expr)
     default:
-        return "", fmt.Errorf("unsupported language: %s", lang)
+        return nil, fmt.Errorf("unsupported language: %s", lang)
     }
+    if err != nil {
+        return nil, err
+    }
+    return extensionResult(result)
 }
-func processLuaExtension(ext Extension, value, composeFileName, expr string) (string, error) {
-    l := lua.NewState()
-    lua.OpenLibraries(l)
 
-    // Set up arguments
-    for argName, arg := range ext.Arguments {
-        switch arg.Type {
-        case "bool":
-            l.PushBoolean(value == "true" || value == "1" || value == "yes")
-        case "int":
-            intValue, err := strconv.Atoi(value)
-            if err != nil {
-                return "", fmt.Errorf("error converting value to int: %v", err)
-            }
-            l.PushInteger(intValue)
-        case "float":
-            floatValue, err := strconv.ParseFloat(value, 64)
-            if err != nil {
-                return "", fmt.Errorf("error converting value to float: %v", err)
-            }
-            l.PushNumber(floatValue)
-        case "env":
-            envValue := os.Getenv(value)
-            if envValue == "" && arg.Default != "" {
-                envValue = os.Getenv(arg.Default)
-            }
-            if envValue == "" {
-                envValue = arg.Default // Use the default value directly if env var is not set
-            }
-            l.PushString(envValue)
-        default: // string
-            l.PushString(value)
+// extensionScript returns the language and source of the generate script of
+// ext.
+func extensionScript(ext Extension) (lang, expr string) {
+    // If no delimiters are found, default to Lua for backward compatibility
+    return splitScript(ext.Generate, "lua")
+}
+
+// splitScript returns the language of a script, by its delimiters, and its
+// source without them. A script without delimiters is in the fallback
+// language.
+func splitScript(script, fallback string) (lang, expr string) {
+    // Determine the language based on the delimiters
+    trimmed := strings.TrimSpace(script)
+
+    if strings.HasPrefix(trimmed, "{{") && strings.HasSuffix(trimmed, "}}") {
+        return "lua", strings.TrimSpace(trimmed[2 : len(trimmed)-2])
+    } else if strings.HasPrefix(trimmed, "[[") && strings.HasSuffix(trimmed, "]]") {
+        return "js", strings.TrimSpace(trimmed[2 : len(trimmed)-2])
+    }
+    return fallback, trimmed
+}
+
+// jsExtensionSource wraps the generate script of a JavaScript extension in a
+// function, so it can return its result.
+func jsExtensionSource(expr string) string {
+    return fmt.Sprintf(`
+        (function() {
+            %s
+        })()
+    `, expr)
+}
+
+// extensionResult converts the value returned by a generate script to the
+// keys to set on the service.
+func extensionResult(result interface{}) (map[string]interface{}, error) {
+    switch r := result.(type) {
+    case nil:
+        return nil, nil
+    case map[string]interface{}:
+        return r, nil
+    case string:
+        // YAML built by the script, as extensions did before they could
+        // return tables and objects
+        if strings.TrimSpace(r) == "" {
+            return nil, nil
         }
-        l.SetGlobal(argName)
+        var resultMap map[string]interface{}
+        if err := yaml.Unmarshal([]byte(r), &resultMap); err != nil {
+            return nil, fmt.Errorf("error parsing extension result: %v\nResult:\n%s", err, r)
+        }
+        return resultMap, nil
     }
+    return nil, fmt.Errorf("extension must return a table/object or a YAML string, got %s", formatExpressionResult(result))
+}
+func processLuaExtension(ctx *scriptContext, args map[string]interface{}, expr string) (interface{}, error) {
+    l := ctx.lua
+    defer l.SetTop(0)
 
-    // Set XDOCKER_COMPOSE_FILE
-    l.PushString(composeFileName)
-    l.SetGlobal("XDOCKER_COMPOSE_FILE")
+    // Arguments are globals for this script only
+    restore := ctx.setLuaGlobals(args)
+    defer restore()
 
+    stop := limitLua(l, ctx.trusted)
+    defer stop()
     if err := lua.DoString(l, expr); err != nil {
-        return "", fmt.Errorf("error evaluating Lua expression: %v", err)
+        return nil, fmt.Errorf("error evaluating Lua expression: %v", err)
     }
 
     if l.Top() == 0 {
-        return "", fmt.Errorf("lua script did not return a value")
+        return nil, fmt.Errorf("lua script did not return a value")
     }
 
-    result := lua.CheckString(l, -1)
-    l.Pop(1)
-
+    result, err := luaToGo(l, 1)
+    if err != nil {
+        return nil, fmt.Errorf("invalid extension result: %v", err)
+    }
     return result, nil
 }
-func processJSExtension(ext Extension, value, composeFileName, expr string) (string, error) {
-    vm := goja.New()
-
-    // Set up arguments
-    for argName, arg := range ext.Arguments {
-        switch arg.Type {
-        case "bool":
-            vm.Set(argName, value == "true" || value == "1" || value == "yes")
-        case "int":
-            intValue, err := strconv.Atoi(value)
-            if err != nil {
-                return "", fmt.Errorf("error converting value to int: %v", err)
-            }
-            vm.Set(argName, intValue)
-        case "float":
-            floatValue, err := strconv.ParseFloat(value, 64)
-            if err != nil {
-                return "", fmt.Errorf("error converting value to float: %v", err)
-            }
-            vm.Set(argName, floatValue)
-        case "env":
-            envValue := os.Getenv(value)
-            if envValue == "" && arg.Default != "" {
-                envValue = os.Getenv(arg.Default)
-            }
-            if envValue == "" {
-                envValue = arg.Default // Use the default value directly if env var is not set
-            }
-            vm.Set(argName, envValue)
-        default: // string
-            vm.Set(argName, value)
-        }
+func processJSExtension(ctx *scriptContext, args map[string]interface{}, expr string) (interface{}, error) {
+    // Arguments are globals for this script only
+    restore, err := ctx.setJSGlobals(args)
+    if err != nil {
+        return nil, err
     }
+    defer restore()
 
-    // Set XDOCKER_COMPOSE_FILE
-    vm.Set("XDOCKER_COMPOSE_FILE", composeFileName)
+    stop := limitJS(ctx.js, ctx.trusted)
+    defer stop()
 
-    // Wrap the expression in a function
-    wrappedExpr := fmt.Sprintf(`
-        (function() {
-            %s
-        })()
-    `, expr)
-
-    result, err := vm.RunString(wrappedExpr)
+    result, err := ctx.js.RunString(jsExtensionSource(expr))
     if err != nil {
-        return "", fmt.Errorf("error evaluating JavaScript expression: %v", err)
+        return nil, fmt.Errorf("error evaluating JavaScript expression: %v", err)
     }
 
-    if goja.IsUndefined(result) || goja.IsNull(result) {
-        return "", nil
+    value, err := jsToGo(result)
+    if err != nil {
+        return nil, fmt.Errorf("invalid extension result: %v", err)
     }
-
-    return result.String(), nil
+    return value, nil
 }
 func runPs(composeFile string) error {
 	cmd := exec.Command("docker-compose", "-f", composeFile, "ps")
@@ -1285,134 +1801,153 @@ func shellExists(containerName, shell string) bool {
 	return cmd.Run() == nil
 }
 
-func addPort(composeFile, service, port string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func addPort(composeFile, service, port string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    if svc, ok := config.Services[service]; ok {
-        svcMap := svc.(map[interface{}]interface{})
-        ports, _ := svcMap["ports"].([]interface{})
-        ports = append(ports, port)
-        svcMap["ports"] = ports
-        config.Services[service] = svcMap
-    } else {
-        return fmt.Errorf("service %s not found", service)
+    doc, ports, err := chain.editSequence(service, "ports", inParent)
+    if err != nil {
+        return err
     }
+    ports.Content = append(ports.Content, quotedNode(port))
+    doc.touch("services", service)
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func removePort(composeFile, port string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func removePort(composeFile, port string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    for service, svc := range config.Services {
-        svcMap := svc.(map[interface{}]interface{})
-        if ports, ok := svcMap["ports"].([]interface{}); ok {
-            newPorts := make([]interface{}, 0)
-            for _, p := range ports {
-                if !strings.HasPrefix(p.(string), port+":") {
-                    newPorts = append(newPorts, p)
-                }
-            }
-            svcMap["ports"] = newPorts
-            config.Services[service] = svcMap
+    for _, service := range chain.serviceNames() {
+        if !chain.sequenceHas(service, "ports", port) {
+            continue
+        }
+        err = chain.editSequenceItems(service, "ports", port, inParent, func(seq *yaml.Node) bool {
+            return removeSequenceItems(seq, port)
+        })
+        if err != nil {
+            return err
         }
     }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func updatePort(composeFile, oldPort, newPort string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func updatePort(composeFile, oldPort, newPort string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    for service, svc := range config.Services {
-        svcMap := svc.(map[interface{}]interface{})
-        if ports, ok := svcMap["ports"].([]interface{}); ok {
-            for i, p := range ports {
-                if strings.HasPrefix(p.(string), oldPort+":") {
-                    ports[i] = newPort
-                }
-            }
-            svcMap["ports"] = ports
-            config.Services[service] = svcMap
+    for _, service := range chain.serviceNames() {
+        if !chain.sequenceHas(service, "ports", oldPort) {
+            continue
+        }
+        err = chain.editSequenceItems(service, "ports", oldPort, inParent, func(seq *yaml.Node) bool {
+            return updateSequenceItems(seq, oldPort, newPort)
+        })
+        if err != nil {
+            return err
         }
     }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func addVolume(composeFile, service, volume string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func addVolume(composeFile, service, volume string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    if svc, ok := config.Services[service]; ok {
-        svcMap := svc.(map[interface{}]interface{})
-        volumes, _ := svcMap["volumes"].([]interface{})
-        volumes = append(volumes, volume)
-        svcMap["volumes"] = volumes
-        config.Services[service] = svcMap
-    } else {
-        return fmt.Errorf("service %s not found", service)
+    doc, volumes, err := chain.editSequence(service, "volumes", inParent)
+    if err != nil {
+        return err
     }
+    volumes.Content = append(volumes.Content, scalarNode(volume))
+    doc.touch("services", service)
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func removeVolume(composeFile, service, volume string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func removeVolume(composeFile, service, volume string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    if svc, ok := config.Services[service]; ok {
-        svcMap := svc.(map[interface{}]interface{})
-        if volumes, ok := svcMap["volumes"].([]interface{}); ok {
-            newVolumes := make([]interface{}, 0)
-            for _, v := range volumes {
-                if !strings.HasPrefix(v.(string), volume+":") {
-                    newVolumes = append(newVolumes, v)
-                }
-            }
-            svcMap["volumes"] = newVolumes
-            config.Services[service] = svcMap
-        }
-    } else {
+    if chain.serviceOwner(service) == nil {
         return fmt.Errorf("service %s not found", service)
     }
+    if chain.sequenceHas(service, "volumes", volume) {
+        err = chain.editSequenceItems(service, "volumes", volume, inParent, func(seq *yaml.Node) bool {
+            return removeSequenceItems(seq, volume)
+        })
+        if err != nil {
+            return err
+        }
+    }
 
-    return writeConfig(composeFile, config)
+    return chain.save()
 }
 
-func updateVolume(composeFile, service, oldVolume, newVolume string) error {
-    config, err := readAndMergeConfigs(composeFile)
+func updateVolume(composeFile, service, oldVolume, newVolume string, inParent bool) error {
+    chain, err := loadComposeChain(composeFile)
     if err != nil {
         return err
     }
 
-    if svc, ok := config.Services[service]; ok {
-        svcMap := svc.(map[interface{}]interface{})
-        if volumes, ok := svcMap["volumes"].([]interface{}); ok {
-            for i, v := range volumes {
-                if strings.HasPrefix(v.(string), oldVolume+":") {
-                    volumes[i] = newVolume
-                }
-            }
-            svcMap["volumes"] = volumes
-            config.Services[service] = svcMap
-        }
-    } else {
+    if chain.serviceOwner(service) == nil {
         return fmt.Errorf("service %s not found", service)
     }
+    if chain.sequenceHas(service, "volumes", oldVolume) {
+        err = chain.editSequenceItems(service, "volumes", oldVolume, inParent, func(seq *yaml.Node) bool {
+            return updateSequenceItems(seq, oldVolume, newVolume)
+        })
+        if err != nil {
+            return err
+        }
+    }
 
-    return writeConfig(composeFile, config)
-}
\ No newline at end of file
+    return chain.save()
+}
+
+// removeSequenceItems drops every "<prefix>:..." scalar from a ports or
+// volumes sequence and reports whether anything was removed.
+func removeSequenceItems(seq *yaml.Node, prefix string) bool {
+    if seq == nil || seq.Kind != yaml.SequenceNode {
+        return false
+    }
+    kept := seq.Content[:0]
+    for _, item := range seq.Content {
+        if item.Kind == yaml.ScalarNode && strings.HasPrefix(item.Value, prefix+":") {
+            continue
+        }
+        kept = append(kept, item)
+    }
+    removed := len(kept) != len(seq.Content)
+    seq.Content = kept
+    return removed
+}
+
+// updateSequenceItems replaces every "<prefix>:..." scalar in a ports or
+// volumes sequence, keeping the item's quoting style and comments.
+func updateSequenceItems(seq *yaml.Node, prefix, value string) bool {
+    if seq == nil || seq.Kind != yaml.SequenceNode {
+        return false
+    }
+    updated := false
+    for _, item := range seq.Content {
+        if item.Kind == yaml.ScalarNode && strings.HasPrefix(item.Value, prefix+":") {
+            item.Value = value
+            item.Tag = "!!str"
+            updated = true
+        }
+    }
+    return updated
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessExtensionResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate string
+		want     interface{}
+		err      string
+	}{
+		{name: "lua table", generate: `{{ return { labels = { team = "a" } } }}`, want: map[string]interface{}{"team": "a"}},
+		{name: "js object", generate: `[[ return { labels: { team: "a" } }; ]]`, want: map[string]interface{}{"team": "a"}},
+		{
+			name:     "lua cycle",
+			generate: `{{ local t = {} t.labels = t return t }}`,
+			err:      `error processing extension team for service "app", key "team": invalid extension result: table contains itself`,
+		},
+		{
+			name:     "js cycle",
+			generate: `[[ var t = {}; t.labels = {t: t}; return t; ]]`,
+			err:      `error processing extension team for service "app", key "team": invalid extension result: object contains itself`,
+		},
+		{
+			name:     "js too deep",
+			generate: `[[ var t = 1; for (var i = 0; i < 200; i++) t = {t: t}; return {labels: t}; ]]`,
+			err:      "invalid extension result: objects nested more than 100 levels deep",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loaded := extensions
+			extensions = map[string]Extension{"team": {Name: "team", Path: "/$service/team", Generate: test.generate}}
+			defer func() { extensions = loaded }()
+
+			config := &XDockerConfig{Services: map[string]interface{}{
+				"app": map[string]interface{}{"image": "nginx", "team": true},
+			}}
+			scripts, err := newScriptContext(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = processCustomInstructions(scripts)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			service := config.Services["app"].(map[string]interface{})
+			if !reflect.DeepEqual(service["labels"], test.want) {
+				t.Errorf("labels = %#v, want %#v", service["labels"], test.want)
+			}
+		})
+	}
+}
+
+func TestExpressionErrorSource(t *testing.T) {
+	tests := []struct {
+		name, base, child string
+		// err is a part of the expected error
+		err string
+	}{
+		{
+			name:  "value of the -f file",
+			base:  "services:\n  web:\n    image: nginx\n",
+			child: "extend: base.yml\nservices:\n  web:\n    image: \"{{ error('x') }}\"\n",
+			err:   `xdocker-compose.yml: service "web", key "image": lua expression failed`,
+		},
+		{
+			name:  "inherited value",
+			base:  "services:\n  web:\n    image: \"{{ error('x') }}\"\n",
+			child: "extend: base.yml\nservices:\n  web:\n    ports: [\"80:80\"]\n",
+			err:   `base.yml: service "web", key "image": lua expression failed`,
+		},
+		{
+			name:  "inherited list item",
+			base:  "services:\n  web:\n    ports: [\"[[ nosuch ]]\"]\n",
+			child: "extend: base.yml\nservices:\n  web:\n    ports: [\"80:80\"]\n",
+			err:   `base.yml: service "web", key "ports.0": js expression failed`,
+		},
+		{
+			name:  "inherited key",
+			base:  "x-labels:\n  \"{{ error('x') }}\": a\n",
+			child: "extend: base.yml\nservices:\n  web:\n    image: nginx\n",
+			err:   `base.yml: key "x-labels.{{ error('x') }}": lua expression failed`,
+		},
+		{
+			name:  "overridden value",
+			base:  "services:\n  web:\n    image: \"{{ error('x') }}\"\n",
+			child: "extend: base.yml\nservices:\n  web:\n    image: \"${MISSING:?is required}\"\n",
+			err:   `xdocker-compose.yml: service "web", key "image": required variable MISSING`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "xdocker-compose.yml")
+			if err := os.WriteFile(filepath.Join(dir, "base.yml"), []byte(test.base), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, []byte(test.child), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := readAndMergeConfigs(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.FileName = file
+			_, err = resolveAllEnvVariablesAndExpressions(config)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// resetValue stands for a value tagged `!reset`: the key is removed from the
+// merged configuration, whatever the extended file declared for it.
+type resetValue struct{}
+
+// overrideValue stands for a value tagged `!override`: it replaces the
+// inherited value as a whole instead of being merged with it.
+type overrideValue struct {
+	value interface{}
+}
+
+// listMergeStrategies tells mergeValues how to combine a list inherited from
+// an extended file with the one the extending file declares, keyed by the
+// path of the list inside a service. Lists that are not listed here are
+// concatenated and de-duplicated, like Compose does for ports or depends_on.
+var listMergeStrategies = map[string]string{
+	"command":          "replace",
+	"entrypoint":       "replace",
+	"healthcheck.test": "replace",
+	"environment":      "keyed",
+	"labels":           "keyed",
+	"annotations":      "keyed",
+	"sysctls":          "keyed",
+	"volumes":          "mount",
+	"devices":          "mount",
+}
+
+// UnmarshalYAML decodes a compose file while keeping the `!reset` and
+// `!override` tags of its sections, which yaml.v3 drops when decoding into
+// interface{} values.
+func (c *XDockerConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plainConfig XDockerConfig
+	if err := node.Decode((*plainConfig)(c)); err != nil {
+		return err
+	}
+	if node.Kind != yaml.MappingNode || !hasMergeTags(node) {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		if !hasMergeTags(value) {
+			continue
+		}
+		decoded, err := decodeComposeNode(value)
+		if err != nil {
+			return err
+		}
+		section, _ := decoded.(map[string]interface{})
+		switch key {
+		case "services":
+			c.Services = section
+		case "networks":
+			c.Networks = section
+		case "volumes":
+			c.Volumes = section
+		case "secrets":
+			c.Secrets = section
+		case "configs":
+			c.Configs = section
+		default:
+			if c.Extra != nil {
+				c.Extra[key] = decoded
+			}
+		}
+	}
+	return nil
+}
+
+// hasMergeTags reports whether a `!reset` or `!override` tag appears
+// anywhere below n.
+func hasMergeTags(n *yaml.Node) bool {
+	if n.Tag == "!reset" || n.Tag == "!override" {
+		return true
+	}
+	for _, child := range n.Content {
+		if hasMergeTags(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeComposeNode decodes n like yaml.v3 would, except that `!reset` and
+// `!override` tagged values become resetValue and overrideValue markers.
+func decodeComposeNode(n *yaml.Node) (interface{}, error) {
+	switch {
+	case n.Tag == "!reset":
+		return resetValue{}, nil
+	case n.Tag == "!override":
+		untagged := *n
+		untagged.Tag = ""
+		value, err := decodeComposeNode(&untagged)
+		if err != nil {
+			return nil, err
+		}
+		return overrideValue{value}, nil
+	case !hasMergeTags(n):
+		var value interface{}
+		if err := n.Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		return decodeComposeNode(n.Alias)
+	case yaml.SequenceNode:
+		list := make([]interface{}, 0, len(n.Content))
+		for _, item := range n.Content {
+			value, err := decodeComposeNode(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		m := make(map[string]interface{})
+		explicit := make(map[string]interface{})
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			decoded, err := decodeComposeNode(value)
+			if err != nil {
+				return nil, err
+			}
+			if key.Tag == "!!merge" || key.Value == "<<" && key.Style == 0 {
+				// `<<: *anchor` merges keys that are not set explicitly
+				sources := []interface{}{decoded}
+				if list, ok := decoded.([]interface{}); ok {
+					sources = list
+				}
+				for _, source := range sources {
+					if sm, ok := source.(map[string]interface{}); ok {
+						for k, v := range sm {
+							if _, exists := m[k]; !exists {
+								m[k] = v
+							}
+						}
+					}
+				}
+				continue
+			}
+			explicit[key.Value] = decoded
+		}
+		for k, v := range explicit {
+			m[k] = v
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("line %d: cannot decode node", n.Line)
+}
+
+// mergeValues deep-merges a value of a service declared by an extending file
+// (child) on top of the inherited one (parent). Maps are merged recursively,
+// lists are combined according to listMergeStrategies and scalars are
+// replaced. path is the dotted key path of the value inside its service.
+func mergeValues(parent, child interface{}, path string) interface{} {
+	return mergeValuesWith(parent, child, path, listMergeStrategies)
+}
+
+// mergeValuesWith is mergeValues with the list strategies to use; values
+// outside of services have none.
+func mergeValuesWith(parent, child interface{}, path string, strategies map[string]string) interface{} {
+	switch c := child.(type) {
+	case resetValue:
+		return c
+	case overrideValue:
+		return c
+	}
+	// markers from files merged earlier have already been applied
+	switch p := parent.(type) {
+	case resetValue:
+		return child
+	case overrideValue:
+		parent = p.value
+	}
+
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if c, ok := child.(map[string]interface{}); ok {
+			return mergeMaps(p, c, path, strategies)
+		}
+		if c, ok := child.([]interface{}); ok && strategies[path] == "keyed" {
+			return mergeMaps(p, keyedListToMap(c), path, strategies)
+		}
+	case []interface{}:
+		if c, ok := child.([]interface{}); ok {
+			return mergeLists(p, c, path, strategies)
+		}
+		if c, ok := child.(map[string]interface{}); ok && strategies[path] == "keyed" {
+			return mergeMaps(keyedListToMap(p), c, path, strategies)
+		}
+	}
+	return child
+}
+
+func mergeMaps(parent, child map[string]interface{}, path string, strategies map[string]string) map[string]interface{} {
+	merged := make(map[string]interface{}, len(parent)+len(child))
+	for key, value := range parent {
+		merged[key] = value
+	}
+	for key, value := range child {
+		if inherited, exists := merged[key]; exists {
+			merged[key] = mergeValuesWith(inherited, value, joinKeyPath(path, key), strategies)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+func mergeLists(parent, child []interface{}, path string, strategies map[string]string) []interface{} {
+	switch strategies[path] {
+	case "replace":
+		return child
+	case "keyed":
+		return mergeListsBy(parent, child, listEntryName)
+	case "mount":
+		return mergeListsBy(parent, child, mountTarget)
+	}
+	return mergeListsBy(parent, child, itemIdentity)
+}
+
+func itemIdentity(item interface{}) (string, bool) {
+	return fmt.Sprintf("%v", item), true
+}
+
+// mergeListsBy concatenates two lists; a child item whose identity (as
+// returned by id) matches an inherited one replaces it in place. Items id
+// finds no identity for are always appended.
+func mergeListsBy(parent, child []interface{}, id func(interface{}) (string, bool)) []interface{} {
+	merged := make([]interface{}, 0, len(parent)+len(child))
+	index := make(map[string]int)
+	for _, list := range [][]interface{}{parent, child} {
+		for _, item := range list {
+			key, ok := id(item)
+			if !ok {
+				merged = append(merged, item)
+				continue
+			}
+			if i, exists := index[key]; exists {
+				merged[i] = item
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// listEntryName returns the variable or label name of a KEY=VALUE entry.
+func listEntryName(item interface{}) (string, bool) {
+	s := fmt.Sprintf("%v", item)
+	if i := strings.Index(s, "="); i >= 0 {
+		return s[:i], true
+	}
+	return s, true
+}
+
+// mountTarget returns the container path of a volume or device entry, in
+// either the short `source:target[:mode]` or the long mapping syntax. A long
+// syntax entry without a target has none.
+func mountTarget(item interface{}) (string, bool) {
+	if m, ok := item.(map[string]interface{}); ok {
+		target, ok := m["target"].(string)
+		return target, ok && target != ""
+	}
+	parts := strings.Split(fmt.Sprintf("%v", item), ":")
+	if len(parts) >= 2 {
+		return parts[1], true
+	}
+	return parts[0], true
+}
+
+// keyedListToMap converts the KEY=VALUE list form of environment or labels
+// to the mapping form, so both forms can be merged with each other.
+func keyedListToMap(list []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(list))
+	for _, item := range list {
+		s := fmt.Sprintf("%v", item)
+		if i := strings.Index(s, "="); i >= 0 {
+			m[s[:i]] = s[i+1:]
+		} else {
+			m[s] = nil
+		}
+	}
+	return m
+}
+
+func joinKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// extensionMergeModes are the modes an extension can declare in its `merge`
+// field for the keys it produces.
+var extensionMergeModes = map[string]bool{
+	"append":  true,
+	"prepend": true,
+	"replace": true,
+}
+
+// mergeExtensionResult merges the keys produced by an extension into a
+// service. By default maps are merged and lists appended the way an extending
+// file is merged (see mergeValues); modes overrides that per dotted key path
+// with `append`, `prepend` or `replace`.
+func mergeExtensionResult(service, result map[string]interface{}, modes map[string]string) {
+	mergeExtensionMaps(service, result, "", modes)
+}
+
+func mergeExtensionMaps(target, result map[string]interface{}, path string, modes map[string]string) {
+	for key, value := range result {
+		if existing, exists := target[key]; exists {
+			value = mergeExtensionValue(existing, value, joinKeyPath(path, key), modes)
+		}
+		target[key] = value
+	}
+}
+
+func mergeExtensionValue(existing, value interface{}, path string, modes map[string]string) interface{} {
+	mode := modes[path]
+	if mode == "replace" {
+		return value
+	}
+	if e, ok := existing.(map[string]interface{}); ok {
+		if v, ok := value.(map[string]interface{}); ok {
+			// merged in place, so other targets of the extension found in
+			// the same document stay attached to it
+			mergeExtensionMaps(e, v, path, modes)
+			return e
+		}
+	}
+	if e, ok := existing.([]interface{}); ok {
+		if v, ok := value.([]interface{}); ok {
+			switch mode {
+			case "append":
+				return mergeListsBy(e, v, itemIdentity)
+			case "prepend":
+				return mergeListsBy(v, e, itemIdentity)
+			}
+		}
+	}
+	return mergeValues(existing, value, path)
+}
+
+// generatedSectionPrefix marks the keys of an extension result that add
+// entries to a top-level section instead of the map of the extension's key:
+// x-xdocker-services, x-xdocker-networks and so on.
+const generatedSectionPrefix = "x-xdocker-"
+
+// generatedSections are the top-level sections an extension can add to.
+var generatedSections = []string{"services", "networks", "volumes", "secrets", "configs"}
+
+// addGeneratedSections moves the x-xdocker-<section> keys of an extension
+// result into the sections of the document root. `$service` in the names of
+// their entries stands for the service the extension was used in. An entry
+// that is already in the document keeps its values and only gets the keys it
+// does not set, so the compose file can adjust what an extension generates.
+func addGeneratedSections(root, result map[string]interface{}, service string) error {
+	for _, section := range generatedSections {
+		key := generatedSectionPrefix + section
+		value, ok := result[key]
+		if !ok {
+			continue
+		}
+		delete(result, key)
+		if value == nil {
+			continue
+		}
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a mapping of %s by name, got %s", key, section, formatExpressionResult(value))
+		}
+		target, _ := root[section].(map[string]interface{})
+		if target == nil {
+			target = make(map[string]interface{})
+			root[section] = target
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entry := entries[name]
+			if strings.Contains(name, "$service") {
+				if service == "" {
+					return fmt.Errorf("%s: %q uses $service, but the extension was not used in a service", key, name)
+				}
+				name = strings.ReplaceAll(name, "$service", service)
+			}
+			existing, exists := target[name]
+			if !exists {
+				target[name] = entry
+				continue
+			}
+			e, eok := existing.(map[string]interface{})
+			g, gok := entry.(map[string]interface{})
+			if eok && gok {
+				addMissingKeys(e, g)
+			}
+		}
+	}
+	return nil
+}
+
+// addMissingKeys adds the keys of generated that target does not have,
+// descending into the maps both have. target is changed in place.
+func addMissingKeys(target, generated map[string]interface{}) {
+	for key, value := range generated {
+		existing, exists := target[key]
+		if !exists {
+			target[key] = value
+			continue
+		}
+		e, eok := existing.(map[string]interface{})
+		v, vok := value.(map[string]interface{})
+		if eok && vok {
+			addMissingKeys(e, v)
+		}
+	}
+}
+
+// stripMergeTags removes the markers left by `!reset` and `!override` once a
+// file has been merged with its parents. It reports false when the value
+// itself was reset and its key should be dropped.
+func stripMergeTags(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case resetValue:
+		return nil, false
+	case overrideValue:
+		return stripMergeTags(v.value)
+	case map[string]interface{}:
+		for key, item := range v {
+			if stripped, keep := stripMergeTags(item); keep {
+				v[key] = stripped
+			} else {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		kept := v[:0]
+		for _, item := range v {
+			if stripped, keep := stripMergeTags(item); keep {
+				kept = append(kept, stripped)
+			}
+		}
+		return kept, true
+	}
+	return value, true
+}
+
+// stripConfigMergeTags applies stripMergeTags to every section of config.
+func stripConfigMergeTags(config *XDockerConfig) {
+	for _, section := range []map[string]interface{}{config.Services, config.Networks, config.Volumes, config.Secrets, config.Configs, config.Extra} {
+		stripMergeTags(section)
+	}
+}
+
+// configSource is a file merged into a configuration, as it was written.
+type configSource struct {
+	file    string
+	content map[string]interface{}
+}
+
+// sourceOf returns the file that defines the string value at path of the
+// merged config: the first of its sources that has the value there, or
+// FileName when there is none. A key of a mapping is found as value at the
+// path ending in the key.
+func (c *XDockerConfig) sourceOf(path []string, value string) string {
+	for _, source := range c.sources {
+		if definesValue(source.content, path, value) {
+			return source.file
+		}
+	}
+	return c.FileName
+}
+
+// definesValue reports whether value is found at path in node. The indexes of
+// merged lists do not match those of the files, so every item of a list is
+// searched.
+func definesValue(node interface{}, path []string, value string) bool {
+	if len(path) == 0 {
+		s, ok := node.(string)
+		return ok && s == value
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[path[0]]
+		if exists && len(path) == 1 && path[0] == value {
+			return true
+		}
+		return exists && definesValue(child, path[1:], value)
+	case []interface{}:
+		for _, item := range n {
+			if definesValue(item, path[1:], value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		name          string
+		parent, child interface{}
+		path          string
+		want          interface{}
+	}{
+		{
+			name:   "scalar is replaced",
+			parent: "nginx:1.25", child: "nginx:1.27",
+			path: "image",
+			want: "nginx:1.27",
+		},
+		{
+			name:   "maps are merged recursively",
+			parent: map[string]interface{}{"test": []interface{}{"CMD", "true"}, "interval": "10s"},
+			child:  map[string]interface{}{"interval": "30s", "retries": 3},
+			path:   "healthcheck",
+			want:   map[string]interface{}{"test": []interface{}{"CMD", "true"}, "interval": "30s", "retries": 3},
+		},
+		{
+			name:   "lists are concatenated without duplicates",
+			parent: []interface{}{"80:80", "443:443"},
+			child:  []interface{}{"443:443", "8080:8080"},
+			path:   "ports",
+			want:   []interface{}{"80:80", "443:443", "8080:8080"},
+		},
+		{
+			name:   "replace strategy",
+			parent: []interface{}{"npm", "start"},
+			child:  []interface{}{"npm", "test"},
+			path:   "command",
+			want:   []interface{}{"npm", "test"},
+		},
+		{
+			name:   "keyed lists replace entries by name",
+			parent: []interface{}{"A=1", "B=2"},
+			child:  []interface{}{"B=3", "C=4"},
+			path:   "environment",
+			want:   []interface{}{"A=1", "B=3", "C=4"},
+		},
+		{
+			name:   "keyed list onto a map",
+			parent: map[string]interface{}{"A": "1", "B": "2"},
+			child:  []interface{}{"B=3", "C"},
+			path:   "environment",
+			want:   map[string]interface{}{"A": "1", "B": "3", "C": nil},
+		},
+		{
+			name:   "keyed map onto a list",
+			parent: []interface{}{"A=1"},
+			child:  map[string]interface{}{"A": "2"},
+			path:   "labels",
+			want:   map[string]interface{}{"A": "2"},
+		},
+		{
+			name:   "mounts replace entries by target",
+			parent: []interface{}{"data:/var/lib/data", "logs:/var/log"},
+			child: []interface{}{
+				"other:/var/lib/data:ro",
+				map[string]interface{}{"type": "bind", "source": "./log", "target": "/var/log"},
+			},
+			path: "volumes",
+			want: []interface{}{
+				"other:/var/lib/data:ro",
+				map[string]interface{}{"type": "bind", "source": "./log", "target": "/var/log"},
+			},
+		},
+		{
+			name:   "nested list strategy uses the full path",
+			parent: map[string]interface{}{"test": []interface{}{"CMD", "a"}},
+			child:  map[string]interface{}{"test": []interface{}{"CMD", "b"}},
+			path:   "healthcheck",
+			want:   map[string]interface{}{"test": []interface{}{"CMD", "b"}},
+		},
+		{
+			name:   "reset in the child wins",
+			parent: []interface{}{"80:80"},
+			child:  resetValue{},
+			path:   "ports",
+			want:   resetValue{},
+		},
+		{
+			name:   "override in the child wins",
+			parent: map[string]interface{}{"A": "1"},
+			child:  overrideValue{map[string]interface{}{"B": "2"}},
+			path:   "environment",
+			want:   overrideValue{map[string]interface{}{"B": "2"}},
+		},
+		{
+			name:   "reset in the parent was applied already",
+			parent: resetValue{},
+			child:  []interface{}{"80:80"},
+			path:   "ports",
+			want:   []interface{}{"80:80"},
+		},
+		{
+			name:   "override in the parent is merged as its value",
+			parent: overrideValue{[]interface{}{"80:80"}},
+			child:  []interface{}{"443:443"},
+			path:   "ports",
+			want:   []interface{}{"80:80", "443:443"},
+		},
+		{
+			name:   "different kinds are replaced",
+			parent: []interface{}{"a"},
+			child:  "b",
+			path:   "dns",
+			want:   "b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergeValues(test.parent, test.child, test.path)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeValues(%v, %v, %q) = %v, want %v", test.parent, test.child, test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeListsBy(t *testing.T) {
+	tests := []struct {
+		name          string
+		parent, child []interface{}
+		id            func(interface{}) (string, bool)
+		want          []interface{}
+	}{
+		{
+			name:   "empty lists",
+			parent: nil, child: nil,
+			id:   itemIdentity,
+			want: []interface{}{},
+		},
+		{
+			name:   "child only",
+			parent: nil, child: []interface{}{"a", "b"},
+			id:   itemIdentity,
+			want: []interface{}{"a", "b"},
+		},
+		{
+			name:   "duplicates within a list collapse",
+			parent: []interface{}{"a", "a"}, child: []interface{}{"b", "a"},
+			id:   itemIdentity,
+			want: []interface{}{"a", "b"},
+		},
+		{
+			name:   "replaced items keep their position",
+			parent: []interface{}{"A=1", "B=2", "C=3"}, child: []interface{}{"A=9"},
+			id:   listEntryName,
+			want: []interface{}{"A=9", "B=2", "C=3"},
+		},
+		{
+			name:   "numbers and strings are the same item",
+			parent: []interface{}{53}, child: []interface{}{"53"},
+			id:   itemIdentity,
+			want: []interface{}{"53"},
+		},
+		{
+			name:   "mount without a target",
+			parent: []interface{}{"/data"}, child: []interface{}{"vol:/data"},
+			id:   mountTarget,
+			want: []interface{}{"vol:/data"},
+		},
+		{
+			name:   "long syntax mounts by target",
+			parent: []interface{}{map[string]interface{}{"source": "a", "target": "/data"}, "b:/logs"},
+			child:  []interface{}{map[string]interface{}{"source": "c", "target": "/data"}, "d:/logs"},
+			id:     mountTarget,
+			want:   []interface{}{map[string]interface{}{"source": "c", "target": "/data"}, "d:/logs"},
+		},
+		{
+			name:   "long syntax mounts without a target are kept",
+			parent: []interface{}{map[string]interface{}{"type": "tmpfs"}},
+			child:  []interface{}{map[string]interface{}{"type": "tmpfs", "tmpfs": map[string]interface{}{"size": 1000}}},
+			id:     mountTarget,
+			want:   []interface{}{map[string]interface{}{"type": "tmpfs"}, map[string]interface{}{"type": "tmpfs", "tmpfs": map[string]interface{}{"size": 1000}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergeListsBy(test.parent, test.child, test.id)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeListsBy(%v, %v) = %v, want %v", test.parent, test.child, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeSection(t *testing.T) {
+	parent := map[string]interface{}{"environment": []interface{}{"A=1"}, "volumes": []interface{}{"a:/data"}}
+	child := map[string]interface{}{"environment": []interface{}{"A=2"}, "volumes": []interface{}{"b:/data"}}
+	tests := []struct {
+		name       string
+		strategies map[string]string
+		want       interface{}
+	}{
+		{
+			name:       "services use the list strategies",
+			strategies: listMergeStrategies,
+			want:       map[string]interface{}{"environment": []interface{}{"A=2"}, "volumes": []interface{}{"b:/data"}},
+		},
+		{
+			name: "other sections and x- keys concatenate lists",
+			want: map[string]interface{}{"environment": []interface{}{"A=1", "A=2"}, "volumes": []interface{}{"a:/data", "b:/data"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergeSection(map[string]interface{}{"x": parent}, map[string]interface{}{"x": child}, test.strategies)
+			if !reflect.DeepEqual(got["x"], test.want) {
+				t.Errorf("mergeSection() = %v, want %v", got["x"], test.want)
+			}
+		})
+	}
+}
+
+func TestReadAndMergeConfigsRecursive(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		order []string
+		// image is the merged image of the web service
+		image string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{
+			name: "multiple parents, the later winning",
+			files: map[string]string{
+				"main.yml": "extend: [a.yml, b.yml]\nservices:\n  web:\n    ports: [\"80:80\"]\n",
+				"a.yml":    "services:\n  web:\n    image: a\n",
+				"b.yml":    "services:\n  web:\n    image: b\n",
+			},
+			order: []string{"a.yml", "b.yml", "main.yml"},
+			image: "b",
+		},
+		{
+			name: "parents of a parent come first",
+			files: map[string]string{
+				"main.yml":   "extend: [a.yml, b.yml]\n",
+				"a.yml":      "extend: base/c.yml\nservices:\n  web:\n    image: a\n",
+				"b.yml":      "services:\n  other:\n    image: b\n",
+				"base/c.yml": "services:\n  web:\n    image: c\n",
+			},
+			order: []string{"base/c.yml", "a.yml", "b.yml", "main.yml"},
+			image: "a",
+		},
+		{
+			name: "diamond is read once, at its first position",
+			files: map[string]string{
+				"main.yml": "extend: [a.yml, b.yml]\n",
+				"a.yml":    "extend: base.yml\n",
+				"b.yml":    "extend: base.yml\nservices:\n  web:\n    image: b\n",
+				"base.yml": "services:\n  web:\n    image: base\n",
+			},
+			order: []string{"base.yml", "a.yml", "b.yml", "main.yml"},
+			image: "b",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.yml": "extend: a.yml\n",
+				"a.yml":    "extend: b.yml\n",
+				"b.yml":    "extend: a.yml\n",
+			},
+			err: "circular dependency detected: a.yml -> b.yml -> a.yml",
+		},
+		{
+			name:  "file extending itself",
+			files: map[string]string{"main.yml": "extend: main.yml\n"},
+			err:   "circular dependency detected: main.yml -> main.yml",
+		},
+		{
+			name:  "missing parent",
+			files: map[string]string{"main.yml": "extend: nope.yml\n"},
+			err:   "error reading xdocker file nope.yml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Relative paths keep the file names in errors short
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			var order []string
+			configs := make(map[string]*XDockerConfig)
+			err = readAndMergeConfigsRecursive("main.yml", nil, configs, &order)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(order, test.order) {
+				t.Errorf("order = %v, want %v", order, test.order)
+			}
+
+			merged, err := readAndMergeConfigs("main.yml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			web, _ := merged.Services["web"].(map[string]interface{})
+			if web["image"] != test.image {
+				t.Errorf("image = %v, want %v", web["image"], test.image)
+			}
+		})
+	}
+}
+
+func TestAddGeneratedSections(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    map[string]interface{}
+		result  map[string]interface{}
+		service string
+		want    map[string]interface{}
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{
+			name: "new sections and entries",
+			root: map[string]interface{}{"services": map[string]interface{}{"web": map[string]interface{}{}}},
+			result: map[string]interface{}{
+				"x-xdocker-services": map[string]interface{}{"$service-proxy": map[string]interface{}{"image": "traefik"}},
+				"x-xdocker-networks": map[string]interface{}{"edge": nil},
+				"labels":             map[string]interface{}{"proxy": "true"},
+			},
+			service: "web",
+			want: map[string]interface{}{
+				"services": map[string]interface{}{"web": map[string]interface{}{}, "web-proxy": map[string]interface{}{"image": "traefik"}},
+				"networks": map[string]interface{}{"edge": nil},
+			},
+		},
+		{
+			name: "existing entries only get missing keys",
+			root: map[string]interface{}{"volumes": map[string]interface{}{
+				"data": map[string]interface{}{"driver": "nfs", "labels": map[string]interface{}{"backup": "daily"}},
+			}},
+			result: map[string]interface{}{"x-xdocker-volumes": map[string]interface{}{
+				"data": map[string]interface{}{"driver": "local", "labels": map[string]interface{}{"backup": "never", "owner": "db"}},
+				"logs": map[string]interface{}{"driver": "local"},
+			}},
+			want: map[string]interface{}{"volumes": map[string]interface{}{
+				"data": map[string]interface{}{"driver": "nfs", "labels": map[string]interface{}{"backup": "daily", "owner": "db"}},
+				"logs": map[string]interface{}{"driver": "local"},
+			}},
+		},
+		{
+			name:   "empty section",
+			root:   map[string]interface{}{},
+			result: map[string]interface{}{"x-xdocker-secrets": nil},
+			want:   map[string]interface{}{},
+		},
+		{
+			name:   "section that is not a mapping",
+			root:   map[string]interface{}{},
+			result: map[string]interface{}{"x-xdocker-configs": []interface{}{"a"}},
+			err:    `x-xdocker-configs must be a mapping of configs by name, got ["a"]`,
+		},
+		{
+			name:   "$service outside of a service",
+			root:   map[string]interface{}{},
+			result: map[string]interface{}{"x-xdocker-networks": map[string]interface{}{"$service-net": nil}},
+			err:    `x-xdocker-networks: "$service-net" uses $service, but the extension was not used in a service`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := addGeneratedSections(test.root, test.result, test.service)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.root, test.want) {
+				t.Errorf("root = %v, want %v", test.root, test.want)
+			}
+			for key := range test.result {
+				if strings.HasPrefix(key, generatedSectionPrefix) {
+					t.Errorf("%s is still in the result", key)
+				}
+			}
+		})
+	}
+}
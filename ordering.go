@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// extensionOrder returns the names of exts in the order they run: an
+// extension runs after the ones listed in its `after` field, and otherwise by
+// priority, lower first, then by name. Names in `after` that are not loaded
+// are ignored; a cycle is an error.
+func extensionOrder(exts map[string]Extension) ([]string, error) {
+	// dependents maps an extension to the ones that must wait for it
+	dependents := make(map[string][]string)
+	waiting := make(map[string]int)
+	for name, ext := range exts {
+		for _, before := range ext.After {
+			if _, ok := exts[before]; ok && before != name {
+				dependents[before] = append(dependents[before], name)
+				waiting[name]++
+			}
+		}
+	}
+
+	var ready []string
+	for name := range exts {
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	less := func(a, b string) bool {
+		if exts[a].Priority != exts[b].Priority {
+			return exts[a].Priority < exts[b].Priority
+		}
+		return a < b
+	}
+
+	order := make([]string, 0, len(exts))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return less(ready[i], ready[j]) })
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) < len(exts) {
+		return nil, fmt.Errorf("extensions depend on each other in a cycle: %s", extensionCycle(exts, waiting))
+	}
+	return order, nil
+}
+
+// extensionCycle describes a cycle among the extensions still waiting for
+// others, e.g. "a -> b -> a".
+func extensionCycle(exts map[string]Extension, waiting map[string]int) string {
+	var start string
+	for name, count := range waiting {
+		if count > 0 && (start == "" || name < start) {
+			start = name
+		}
+	}
+
+	// Follow `after` links between waiting extensions until one repeats
+	seen := make(map[string]int)
+	var chain []string
+	for name := start; ; {
+		if i, ok := seen[name]; ok {
+			return strings.Join(append(chain[i:], name), " -> ")
+		}
+		seen[name] = len(chain)
+		chain = append(chain, name)
+		after := append([]string(nil), exts[name].After...)
+		sort.Strings(after)
+		for _, before := range after {
+			if waiting[before] > 0 {
+				name = before
+				break
+			}
+		}
+	}
+}
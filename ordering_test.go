@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtensionOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		exts []Extension
+		want []string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{name: "none", exts: nil, want: []string{}},
+		{
+			name: "by name",
+			exts: []Extension{{Name: "c"}, {Name: "a"}, {Name: "b"}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "by priority, then name",
+			exts: []Extension{{Name: "a", Priority: 10}, {Name: "b", Priority: -1}, {Name: "c"}, {Name: "d", Priority: 10}},
+			want: []string{"b", "c", "a", "d"},
+		},
+		{
+			name: "after wins over priority",
+			exts: []Extension{{Name: "a", After: []string{"z"}}, {Name: "z", Priority: 5}},
+			want: []string{"z", "a"},
+		},
+		{
+			name: "chain",
+			exts: []Extension{{Name: "a", After: []string{"b"}}, {Name: "b", After: []string{"c"}}, {Name: "c"}},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name: "several dependencies",
+			exts: []Extension{{Name: "a", After: []string{"c", "b"}}, {Name: "b"}, {Name: "c", Priority: 1}, {Name: "d", Priority: 2}},
+			want: []string{"b", "c", "a", "d"},
+		},
+		{
+			name: "released extensions are ordered with the rest",
+			exts: []Extension{{Name: "a"}, {Name: "b", After: []string{"a"}}, {Name: "c", Priority: 1}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "unknown and own names in after are ignored",
+			exts: []Extension{{Name: "a", After: []string{"missing", "a"}}, {Name: "b"}},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "cycle",
+			exts: []Extension{{Name: "b", After: []string{"a"}}, {Name: "a", After: []string{"b"}}},
+			err:  "extensions depend on each other in a cycle: a -> b -> a",
+		},
+		{
+			name: "cycle behind a dependent",
+			exts: []Extension{
+				{Name: "a", After: []string{"c"}},
+				{Name: "c", After: []string{"e"}},
+				{Name: "d", After: []string{"c"}},
+				{Name: "e", After: []string{"d"}},
+				{Name: "f"},
+			},
+			err: "in a cycle: c -> e -> d -> c",
+		},
+		{
+			name: "longer cycle",
+			exts: []Extension{{Name: "x", After: []string{"y"}}, {Name: "y", After: []string{"z"}}, {Name: "z", After: []string{"x"}}},
+			err:  "cycle: x -> y -> z -> x",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exts := make(map[string]Extension)
+			for _, ext := range test.exts {
+				exts[ext.Name] = ext
+			}
+			got, err := extensionOrder(exts)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("extensionOrder() error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extensionOrder(): %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("extensionOrder() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+)
+
+var (
+	// trustScripts gives every expression and extension the full Lua and
+	// JavaScript runtime, as if it was trusted
+	trustScripts bool
+	// luaLibraries are the Lua standard libraries untrusted scripts can use
+	luaLibraries = defaultLuaLibraries
+	// scriptTimeout limits how long a single untrusted script may run
+	scriptTimeout = 5 * time.Second
+	// scriptMaxInstructions limits the number of Lua instructions a single
+	// untrusted script may execute
+	scriptMaxInstructions = 50000000
+	// scriptMaxMemory limits how much the heap may grow while a single
+	// untrusted script runs
+	scriptMaxMemory uint64 = 256 << 20
+)
+
+const defaultLuaLibraries = "base,table,string,math,bit32,os"
+
+// luaOpeners are the Lua standard libraries by the names used in the
+// --lua-libs allowlist.
+var luaOpeners = []struct {
+	name, module string
+	open         lua.Function
+}{
+	{"base", "_G", lua.BaseOpen},
+	{"package", "package", lua.PackageOpen},
+	{"table", "table", lua.TableOpen},
+	{"io", "io", lua.IOOpen},
+	{"os", "os", lua.OSOpen},
+	{"string", "string", lua.StringOpen},
+	{"bit32", "bit32", lua.Bit32Open},
+	{"math", "math", lua.MathOpen},
+	{"debug", "debug", lua.DebugOpen},
+}
+
+// unsafeLuaFunctions are removed from the allowed libraries of untrusted
+// scripts: they run programs, touch the file system or end the process.
+var unsafeLuaFunctions = map[string][]string{
+	"_G": {"dofile", "loadfile"},
+	"os": {"execute", "exit", "remove", "rename", "tmpname", "setlocale"},
+	"io": {"popen"},
+}
+
+// maxStringRep caps the size of strings built with string.rep and
+// String.prototype.repeat by untrusted scripts, which would otherwise allocate
+// any amount of memory in a single instruction.
+const maxStringRep = 16 << 20
+
+// validateLuaLibraries checks a comma separated --lua-libs allowlist.
+func validateLuaLibraries(allowlist string) error {
+	for _, name := range strings.Split(allowlist, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, opener := range luaOpeners {
+			found = found || opener.name == name
+		}
+		if !found {
+			return fmt.Errorf("unknown Lua library %q in --lua-libs", name)
+		}
+	}
+	return nil
+}
+
+// newLuaState returns a Lua state with the standard libraries a script may
+// use: all of them when it is trusted, the luaLibraries allowlist without
+// unsafe functions otherwise.
+func newLuaState(trusted bool) *lua.State {
+	l := lua.NewState()
+	if trusted || trustScripts {
+		lua.OpenLibraries(l)
+		return l
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(luaLibraries, ",") {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	for _, opener := range luaOpeners {
+		if !allowed[opener.name] {
+			continue
+		}
+		lua.Require(l, opener.module, opener.open, true)
+		for _, name := range unsafeLuaFunctions[opener.module] {
+			l.PushNil()
+			l.SetField(-2, name)
+		}
+		if opener.module == "string" {
+			l.Field(-1, "rep")
+			l.PushGoClosure(limitedStringRep, 1)
+			l.SetField(-2, "rep")
+		}
+		l.Pop(1)
+	}
+	return l
+}
+
+// limitedStringRep wraps string.rep, kept as upvalue 1, to refuse results
+// larger than maxStringRep.
+func limitedStringRep(l *lua.State) int {
+	s := lua.CheckString(l, 1)
+	n := lua.CheckInteger(l, 2)
+	sep := lua.OptString(l, 3, "")
+	if n > 0 && (len(s)+len(sep))*n > maxStringRep {
+		lua.Errorf(l, "string.rep result too large")
+	}
+	l.PushValue(lua.UpValueIndex(1))
+	l.Insert(1)
+	l.Call(l.Top()-1, 1)
+	return 1
+}
+
+// newJSRuntime returns a JavaScript VM for a script. Unless it is trusted,
+// String.prototype.repeat refuses results larger than maxStringRep.
+func newJSRuntime(trusted bool) *goja.Runtime {
+	vm := goja.New()
+	if trusted || trustScripts {
+		return vm
+	}
+	proto := vm.Get("String").ToObject(vm).Get("prototype").ToObject(vm)
+	repeat, _ := goja.AssertFunction(proto.Get("repeat"))
+	proto.Set("repeat", func(call goja.FunctionCall) goja.Value {
+		s := call.This.String()
+		if n := call.Argument(0).ToInteger(); n > 0 && int64(len(s))*n > maxStringRep {
+			panic(vm.NewGoError(fmt.Errorf("String.prototype.repeat result too large")))
+		}
+		result, err := repeat(call.This, call.Arguments...)
+		if err != nil {
+			panic(err)
+		}
+		return result
+	})
+	return vm
+}
+
+// limitLua installs the time, instruction and memory limits on an untrusted
+// script about to run in l. The returned function removes them again.
+func limitLua(l *lua.State, trusted bool) func() {
+	if trusted || trustScripts {
+		return func() {}
+	}
+	const step = 100
+	deadline := time.Now().Add(scriptTimeout)
+	instructions := 0
+	var exceeded atomic.Bool
+	stopWatch := watchMemory(func() { exceeded.Store(true) })
+	lua.SetDebugHook(l, func(l *lua.State, _ lua.Debug) {
+		instructions += step
+		if instructions > scriptMaxInstructions {
+			lua.Errorf(l, "script exceeded the limit of %d instructions", scriptMaxInstructions)
+		}
+		if exceeded.Load() {
+			lua.Errorf(l, "script exceeded the memory limit of %d MB", int(scriptMaxMemory>>20))
+		}
+		if time.Now().After(deadline) {
+			lua.Errorf(l, "script exceeded the time limit of %v", scriptTimeout)
+		}
+	}, lua.MaskCount, step)
+	return func() {
+		stopWatch()
+		lua.SetDebugHook(l, nil, 0, 0)
+	}
+}
+
+// limitJS interrupts an untrusted script running in vm once it exceeds the
+// time or the memory limit. The returned function cancels the timer and the
+// memory watch.
+func limitJS(vm *goja.Runtime, trusted bool) func() {
+	if trusted || trustScripts {
+		return func() {}
+	}
+	vm.SetMaxCallStackSize(10000)
+	timer := time.AfterFunc(scriptTimeout, func() {
+		vm.Interrupt(fmt.Sprintf("script exceeded the time limit of %v", scriptTimeout))
+	})
+	stopWatch := watchMemory(func() {
+		vm.Interrupt(fmt.Sprintf("script exceeded the memory limit of %d MB", scriptMaxMemory>>20))
+	})
+	return func() {
+		timer.Stop()
+		stopWatch()
+		vm.ClearInterrupt()
+	}
+}
+
+// watchMemory calls exceeded once the heap grows by more than scriptMaxMemory
+// from now, even after a garbage collection. The heap is that of the whole
+// process: scripts run one at a time, so its growth is what the running
+// script allocates and keeps. The heap is checked every 10 milliseconds until
+// the returned function is called.
+func watchMemory(exceeded func()) func() {
+	limit := heapBytes() + scriptMaxMemory
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if heapBytes() <= limit {
+				continue
+			}
+			// Only count what the script keeps, not its garbage
+			runtime.GC()
+			if heapBytes() > limit {
+				exceeded()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// heapBytes returns the size of the objects on the heap, including those not
+// collected yet.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
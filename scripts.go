@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dop251/goja"
+	"github.com/tluyben/go-lua"
+)
+
+// preludeKey is the top-level key holding code that is evaluated once before
+// the expressions of the compose file.
+const preludeKey = "x-xdocker-prelude"
+
+// savedGlobalsKey is the registry field of the Lua state holding the globals
+// a script run replaced.
+const savedGlobalsKey = "xdocker.savedGlobals"
+
+// scriptContext holds the Lua state and JavaScript VM shared by all
+// expressions, extensions and hooks of a run, so functions and variables
+// defined by the prelude or by one script are visible to the following ones.
+type scriptContext struct {
+	config    *XDockerConfig
+	helpers   *helperContext
+	lua       *lua.State
+	js        *goja.Runtime
+	jsHelpers *goja.Object
+	// trusted runtimes have the full Lua and JavaScript libraries and no
+	// limits
+	trusted bool
+}
+
+// newScriptContext sets up the runtimes for the scripts of config and
+// evaluates its prelude, which is removed from the configuration.
+func newScriptContext(config *XDockerConfig) (*scriptContext, error) {
+	ctx := newRuntimes(*newHelperContext(config, ""), false)
+	prelude, exists := config.Extra[preludeKey]
+	if !exists {
+		return ctx, nil
+	}
+	delete(config.Extra, preludeKey)
+	return ctx, ctx.runPrelude(prelude)
+}
+
+// newRuntimes returns a Lua state and JavaScript VM with the helper library,
+// working on a copy of helpers.
+func newRuntimes(helpers helperContext, trusted bool) *scriptContext {
+	helpers.trusted = trusted
+	ctx := &scriptContext{
+		config:  helpers.config,
+		helpers: &helpers,
+		lua:     newLuaState(trusted),
+		js:      newJSRuntime(trusted),
+		trusted: trusted,
+	}
+	for name, value := range map[string]string{"XDOCKER_COMPOSE_FILE": helpers.composeFile, "XDOCKER_ENV": xdockerEnv} {
+		ctx.lua.PushString(value)
+		ctx.lua.SetGlobal(name)
+		ctx.js.Set(name, value)
+	}
+	openLuaHelpers(ctx.lua, ctx.helpers)
+	ctx.jsHelpers = openJSHelpers(ctx.js, ctx.helpers)
+	return ctx
+}
+
+// runtimeFor returns the context the scripts of ext run in. That is ctx,
+// unless ext is trusted on its own: it gets new runtimes without limits,
+// which do not see the prelude or the other scripts.
+func (ctx *scriptContext) runtimeFor(ext Extension) *scriptContext {
+	if !ext.Trusted || ctx.trusted || trustScripts {
+		return ctx
+	}
+	return newRuntimes(*ctx.helpers, true)
+}
+
+// runPrelude evaluates the `lua` and `js` code of the prelude.
+func (ctx *scriptContext) runPrelude(prelude interface{}) error {
+	if prelude == nil {
+		return nil
+	}
+	code, ok := prelude.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s must be a mapping with lua and/or js code, got %T", preludeKey, prelude)
+	}
+	langs := make([]string, 0, len(code))
+	for lang := range code {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		src, ok := code[lang].(string)
+		if !ok {
+			return fmt.Errorf("%s.%s must be a string, got %T", preludeKey, lang, code[lang])
+		}
+		var err error
+		switch lang {
+		case "lua":
+			err = ctx.runLuaPrelude(src)
+		case "js":
+			err = ctx.runJSPrelude(src)
+		default:
+			return fmt.Errorf("%s: unsupported language %q, expected lua or js", preludeKey, lang)
+		}
+		if err != nil {
+			return fmt.Errorf("error in %s.%s: %v", preludeKey, lang, err)
+		}
+	}
+	return nil
+}
+
+func (ctx *scriptContext) runLuaPrelude(src string) error {
+	l := ctx.lua
+	defer l.SetTop(0)
+	if err := lua.LoadString(l, src); err != nil {
+		return err
+	}
+	stop := limitLua(l, false)
+	defer stop()
+	return l.ProtectedCall(0, 0, 0)
+}
+
+func (ctx *scriptContext) runJSPrelude(src string) error {
+	stop := limitJS(ctx.js, false)
+	defer stop()
+	_, err := ctx.js.RunString(src)
+	return err
+}
+
+// setService makes service the current service of the helper library.
+func (ctx *scriptContext) setService(service string) {
+	ctx.helpers.service = service
+
+	l := ctx.lua
+	l.Global("xdocker")
+	if l.IsTable(-1) {
+		if service == "" {
+			l.PushNil()
+		} else {
+			l.PushString(service)
+		}
+		l.SetField(-2, "service")
+	}
+	l.Pop(1)
+
+	if service == "" {
+		ctx.jsHelpers.Delete("service")
+	} else {
+		ctx.jsHelpers.Set("service", service)
+	}
+}
+
+// setLuaGlobals sets the arguments of an extension, or the variables of a
+// hook, as globals of the Lua state. The returned function restores the
+// globals they replaced, so they do not leak into the following scripts.
+func (ctx *scriptContext) setLuaGlobals(globals map[string]interface{}) func() {
+	l := ctx.lua
+	l.NewTable()
+	for name, value := range globals {
+		l.Global(name)
+		l.SetField(-2, name)
+		pushLuaValue(l, value)
+		l.SetGlobal(name)
+	}
+	l.SetField(lua.RegistryIndex, savedGlobalsKey)
+	return func() {
+		l.Field(lua.RegistryIndex, savedGlobalsKey)
+		for name := range globals {
+			l.Field(-1, name)
+			l.SetGlobal(name)
+		}
+		l.Pop(1)
+	}
+}
+
+// setJSGlobals is setLuaGlobals for the JavaScript VM.
+func (ctx *scriptContext) setJSGlobals(globals map[string]interface{}) (func(), error) {
+	global := ctx.js.GlobalObject()
+	saved := make(map[string]goja.Value)
+	restore := func() {
+		for name, value := range saved {
+			if value == nil {
+				global.Delete(name)
+			} else {
+				global.Set(name, value)
+			}
+		}
+	}
+	for name, value := range globals {
+		v, err := jsValue(ctx.js, value)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("error passing argument %s: %v", name, err)
+		}
+		saved[name] = global.Get(name)
+		global.Set(name, v)
+	}
+	return restore, nil
+}
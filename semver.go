@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a semantic version: MAJOR.MINOR.PATCH with an optional
+// pre-release part. Build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses a version such as `1.2.3`, `v1.2` or `2.0.0-beta.1`.
+// Missing minor and patch numbers are 0.
+func parseSemver(s string) (semver, error) {
+	var v semver
+	text := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(text, "+"); i >= 0 {
+		text = text[:i]
+	}
+	if i := strings.Index(text, "-"); i >= 0 {
+		text, v.prerelease = text[:i], text[i+1:]
+		if v.prerelease == "" {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+	}
+	parts := strings.Split(text, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	numbers := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.prerelease != "" {
+		s += "-" + v.prerelease
+	}
+	return s
+}
+
+// compare returns -1, 0 or 1 as v is older than, the same as or newer than
+// other. A pre-release is older than its release.
+func (v semver) compare(other semver) int {
+	for _, d := range []int{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	}
+	return comparePrerelease(v.prerelease, other.prerelease)
+}
+
+// comparePrerelease compares pre-release parts identifier by identifier:
+// numbers numerically and before words, words alphabetically.
+func comparePrerelease(a, b string) int {
+	x, y := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(x) && i < len(y); i++ {
+		m, merr := strconv.Atoi(x[i])
+		n, nerr := strconv.Atoi(y[i])
+		switch {
+		case merr == nil && nerr == nil:
+			if m != n {
+				return sign(m - n)
+			}
+		case merr == nil:
+			return -1
+		case nerr == nil:
+			return 1
+		default:
+			if c := strings.Compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(x) - len(y))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// versionSatisfies reports whether version meets a constraint: comparisons
+// such as `>=1.2, <2` separated by commas, which must all hold. A version
+// without an operator is a minimum. An empty constraint allows any version.
+func versionSatisfies(version, constraint string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		op := ">="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op, part = candidate, strings.TrimSpace(part[len(candidate):])
+				break
+			}
+		}
+		required, err := parseSemver(part)
+		if err != nil {
+			return false, fmt.Errorf("invalid version constraint %q: %v", constraint, err)
+		}
+		c := v.compare(required)
+		ok := map[string]bool{
+			">=": c >= 0, "<=": c <= 0, ">": c > 0, "<": c < 0, "=": c == 0, "!=": c != 0,
+		}[op]
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
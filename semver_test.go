@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		input string
+		want  semver
+		err   bool
+	}{
+		{input: "1.2.3", want: semver{1, 2, 3, ""}},
+		{input: "v1.2.3", want: semver{1, 2, 3, ""}},
+		{input: "2", want: semver{2, 0, 0, ""}},
+		{input: "2.0.0-beta.1", want: semver{2, 0, 0, "beta.1"}},
+		{input: "1.0.0-rc.1+build.5", want: semver{1, 0, 0, "rc.1"}},
+		{input: "", err: true},
+		{input: "1.2.3.4", err: true},
+		{input: "1.x", err: true},
+		{input: "1.0.0-", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parseSemver(test.input)
+			if test.err {
+				if err == nil {
+					t.Errorf("parseSemver(%q) = %v, want an error", test.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSemver(%q): %v", test.input, err)
+			}
+			if got != test.want {
+				t.Errorf("parseSemver(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	tests := []struct {
+		version, constraint string
+		want                bool
+		err                 bool
+	}{
+		{version: "1.0.0", constraint: "", want: true},
+		{version: "1.2.0", constraint: "1.1", want: true},
+		{version: "1.2.0", constraint: ">=1.2", want: true},
+		{version: "1.2.1", constraint: ">1.2", want: true},
+		{version: "1.9.9", constraint: "<2", want: true},
+		{version: "2.0.0", constraint: "<2", want: false},
+		{version: "1.2.3", constraint: "=1.2.3", want: true},
+		{version: "1.5.0", constraint: ">=1.2, <2", want: true},
+		{version: "1.5.0", constraint: " >= 1.2 ,, < 2 ", want: true},
+
+		{version: "2.0.0-beta", constraint: ">=2.0.0", want: false},
+		{version: "2.0.0-beta", constraint: "<2.0.0", want: true},
+		{version: "2.0.0-beta.2", constraint: ">2.0.0-beta.1", want: true},
+		{version: "2.0.0-1", constraint: "<2.0.0-alpha", want: true},
+		{version: "1.0.0+a", constraint: "=1.0.0+b", want: true},
+
+		{version: "next", constraint: ">=1", err: true},
+		{version: "1.0.0", constraint: "~>1.0", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.version+" "+test.constraint, func(t *testing.T) {
+			got, err := versionSatisfies(test.version, test.constraint)
+			if test.err {
+				if err == nil {
+					t.Errorf("versionSatisfies(%q, %q) = %t, want an error", test.version, test.constraint, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("versionSatisfies(%q, %q): %v", test.version, test.constraint, err)
+			}
+			if got != test.want {
+				t.Errorf("versionSatisfies(%q, %q) = %t, want %t", test.version, test.constraint, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expressionLanguages lists the delimiters of the expression blocks.
+var expressionLanguages = []struct {
+	lang, open, close string
+}{
+	{"lua", "{{", "}}"},
+	{"js", "[[", "]]"},
+}
+
+// expressionToken is a piece of a scanned string: literal text, or an
+// expression block.
+type expressionToken struct {
+	text string // the literal text, or the whole block including delimiters
+	lang string // language of an expression block, empty for literal text
+	body string // source between the delimiters of an expression block
+}
+
+// scanExpressions splits s into literal text and expression blocks. Blocks
+// may span several lines and contain brackets, strings and comments of their
+// language, so a Lua table such as `{{ {a = {1}} }}` or a JavaScript
+// `[[ m[k[0]] ]]` is read as a single block; the closing delimiter only counts
+// outside of them. A backslash before a delimiter (`\{{`, `\[[`) yields the
+// delimiter as literal text.
+func scanExpressions(s string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && delimiterAt(s, i+1) >= 0 {
+			text.WriteString(s[i+1 : i+3])
+			i += 2
+			continue
+		}
+		d := delimiterAt(s, i)
+		if d < 0 {
+			text.WriteByte(s[i])
+			continue
+		}
+
+		language := expressionLanguages[d]
+		start := i + len(language.open)
+		end, err := scanExpressionBody(s, start, language.lang, language.close)
+		if err != nil {
+			return nil, err
+		}
+		if text.Len() > 0 {
+			tokens = append(tokens, expressionToken{text: text.String()})
+			text.Reset()
+		}
+		tokens = append(tokens, expressionToken{
+			text: s[i : end+len(language.close)],
+			lang: language.lang,
+			body: s[start:end],
+		})
+		i = end + len(language.close) - 1
+	}
+	if text.Len() > 0 {
+		tokens = append(tokens, expressionToken{text: text.String()})
+	}
+	return tokens, nil
+}
+
+// delimiterAt returns the index in expressionLanguages of the block opened at
+// s[i], or -1.
+func delimiterAt(s string, i int) int {
+	for d, language := range expressionLanguages {
+		if strings.HasPrefix(s[i:], language.open) {
+			return d
+		}
+	}
+	return -1
+}
+
+// scanExpressionBody returns the index of the delimiter closing the block
+// whose body starts at start.
+func scanExpressionBody(s string, start int, lang, close string) (int, error) {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case depth == 0 && strings.HasPrefix(s[i:], close):
+			return i, nil
+		case c == '"' || c == '\'' || c == '`' && lang == "js":
+			end := skipQuoted(s, i)
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated string in %s expression %s", lang, previewExpression(s[start-2:]))
+			}
+			i = end
+		case lang == "lua" && strings.HasPrefix(s[i:], "--"):
+			i = skipLuaComment(s, i)
+		case lang == "lua" && luaLongBracket(s, i) >= 0:
+			end := skipLuaLongString(s, i)
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated long string in lua expression %s", previewExpression(s[start-2:]))
+			}
+			i = end
+		case lang == "js" && strings.HasPrefix(s[i:], "//"):
+			i = skipLine(s, i)
+		case lang == "js" && strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated comment in js expression %s", previewExpression(s[start-2:]))
+			}
+			i += end + 3
+		case c == '{' || c == '[' || c == '(':
+			depth++
+		case c == '}' || c == ']' || c == ')':
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated %s expression %s: missing %s", lang, previewExpression(s[start-2:]), close)
+}
+
+// skipQuoted returns the index of the quote closing the string literal
+// opened at s[i], or -1.
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case quote:
+			return j
+		}
+	}
+	return -1
+}
+
+func skipLine(s string, i int) int {
+	if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+		return i + end
+	}
+	return len(s) - 1
+}
+
+// skipLuaComment returns the index of the last character of the Lua comment
+// starting at s[i], a `--` line comment or a `--[[ ]]` block comment.
+func skipLuaComment(s string, i int) int {
+	if luaLongBracket(s, i+2) >= 0 {
+		if end := skipLuaLongString(s, i+2); end >= 0 {
+			return end
+		}
+	}
+	return skipLine(s, i)
+}
+
+// luaLongBracket returns the level of the Lua long bracket (`[[`, `[=[`, ...)
+// opened at s[i], or -1.
+func luaLongBracket(s string, i int) int {
+	if i >= len(s) || s[i] != '[' {
+		return -1
+	}
+	level := 0
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '=':
+			level++
+		case '[':
+			return level
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// skipLuaLongString returns the index of the last character of the long
+// string opened at s[i], or -1.
+func skipLuaLongString(s string, i int) int {
+	level := luaLongBracket(s, i)
+	close := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(s[i+level+2:], close)
+	if end < 0 {
+		return -1
+	}
+	return i + level + 2 + end + len(close) - 1
+}
+
+// previewExpression shortens the source of a block for error messages.
+func previewExpression(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i] + " ..."
+	}
+	if len(s) > 40 {
+		s = s[:40] + " ..."
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanExpressions(t *testing.T) {
+	text := func(s string) expressionToken { return expressionToken{text: s} }
+	block := func(lang, open, body, close string) expressionToken {
+		return expressionToken{text: open + body + close, lang: lang, body: body}
+	}
+	lua := func(body string) expressionToken { return block("lua", "{{", body, "}}") }
+	js := func(body string) expressionToken { return block("js", "[[", body, "]]") }
+
+	tests := []struct {
+		name  string
+		input string
+		want  []expressionToken
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{name: "plain text", input: "nginx:latest", want: []expressionToken{text("nginx:latest")}},
+		{name: "empty", input: "", want: nil},
+		{
+			name:  "blocks between text",
+			input: "a-{{ 1 + 1 }}-[[ 2 * 2 ]]-b",
+			want:  []expressionToken{text("a-"), lua(" 1 + 1 "), text("-"), js(" 2 * 2 "), text("-b")},
+		},
+		{
+			name:  "adjacent blocks",
+			input: "{{1}}{{2}}",
+			want:  []expressionToken{lua("1"), lua("2")},
+		},
+		{
+			name:  "nested Lua tables",
+			input: "{{ {a = {1}} }}",
+			want:  []expressionToken{lua(" {a = {1}} ")},
+		},
+		{
+			name:  "nested JavaScript indexing",
+			input: "[[ m[k[0]] ]]",
+			want:  []expressionToken{js(" m[k[0]] ")},
+		},
+		{
+			name:  "multi-line block",
+			input: "{{\n  local x = 1\n  return x\n}}",
+			want:  []expressionToken{lua("\n  local x = 1\n  return x\n")},
+		},
+		{
+			name:  "delimiters in strings",
+			input: `{{ "}}" .. '}}' }} [[ "]]" + '\']]' + ` + "`]]`" + ` ]]`,
+			want: []expressionToken{
+				lua(` "}}" .. '}}' `), text(" "), js(` "]]" + '\']]' + ` + "`]]`" + ` `),
+			},
+		},
+		{
+			name:  "Lua long strings",
+			input: "{{ [[ }} ]] .. [==[ ]] }} ]==] }}",
+			want:  []expressionToken{lua(" [[ }} ]] .. [==[ ]] }} ]==] ")},
+		},
+		{
+			name:  "Lua comments",
+			input: "{{ 1 -- }}\n + 2 --[[ }} ]] }}",
+			want:  []expressionToken{lua(" 1 -- }}\n + 2 --[[ }} ]] ")},
+		},
+		{
+			name:  "JavaScript comments",
+			input: "[[ 1 // ]]\n + 2 /* ]] */ ]]",
+			want:  []expressionToken{js(" 1 // ]]\n + 2 /* ]] */ ")},
+		},
+		{
+			name:  "escaped delimiters",
+			input: `\{{ not lua }} \[[ not js ]] {{ 1 }}`,
+			want:  []expressionToken{text("{{ not lua }} [[ not js ]] "), lua(" 1 ")},
+		},
+		{
+			name:  "lone backslash",
+			input: `C:\path {{ 1 }}`,
+			want:  []expressionToken{text(`C:\path `), lua(" 1 ")},
+		},
+		{name: "unterminated block", input: "{{ 1 + 1", err: "unterminated lua expression {{ 1 + 1: missing }}"},
+		{name: "unterminated string", input: `[[ "abc ]]`, err: "unterminated string in js expression"},
+		{name: "unterminated long string", input: "{{ [[ abc }}", err: "unterminated long string in lua expression"},
+		{name: "unterminated comment", input: "[[ /* abc ]]", err: "unterminated comment in js expression"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := scanExpressions(test.input)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("scanExpressions(%q) error = %v, want one containing %q", test.input, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scanExpressions(%q): %v", test.input, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("scanExpressions(%q) =\n%#v\nwant\n%#v", test.input, got, test.want)
+			}
+		})
+	}
+}
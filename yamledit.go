@@ -0,0 +1,763 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// composeDocument is an xdocker compose file loaded as a yaml.Node tree.
+// Mutation commands edit the tree and save() splices only the touched
+// entries back into the original text, so comments, key order, anchors and
+// formatting of everything else stay byte-for-byte the same.
+//
+// Entries are tracked at two levels: top-level keys (services, volumes, ...)
+// and the entries directly below them (a single service, a single volume).
+// Touching anything inside a service re-encodes that service only.
+type composeDocument struct {
+	path   string
+	doc    *yaml.Node
+	lines  []string
+	indent int
+
+	// original layout of the file, keyed by the key node of each entry
+	entries map[*yaml.Node]*docEntry
+	order   []*docEntry
+	// preamble is everything before the first top-level entry
+	preamble int
+
+	dirty   map[*yaml.Node]bool
+	changed bool
+}
+
+// docEntry is the position of one mapping entry in the original text.
+// Lines are 0-based; head covers the comment block directly above the key,
+// trailer the blank and comment lines between the entry and its next sibling.
+type docEntry struct {
+	key        *yaml.Node
+	value      *yaml.Node
+	headStart  int
+	keyLine    int
+	contentEnd int
+	regionEnd  int
+	kind       yaml.Kind
+	style      yaml.Style
+	children   []*docEntry
+}
+
+func loadComposeDocument(path string) (*composeDocument, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading xdocker file %s: %v", path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing xdocker file %s: %v", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode}
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("error parsing xdocker file %s: top level is not a mapping", path)
+	}
+
+	d := &composeDocument{
+		path:    path,
+		doc:     &doc,
+		lines:   strings.SplitAfter(string(data), "\n"),
+		indent:  detectIndent(doc.Content[0]),
+		entries: make(map[*yaml.Node]*docEntry),
+		dirty:   make(map[*yaml.Node]bool),
+	}
+	if n := len(d.lines); n > 0 && d.lines[n-1] == "" {
+		d.lines = d.lines[:n-1]
+	}
+
+	top := doc.Content[0]
+	if top.Style&yaml.FlowStyle == 0 && len(top.Content) > 0 {
+		d.order = d.layoutEntries(top, len(d.lines))
+		d.preamble = d.order[0].headStart
+		for _, e := range d.order {
+			if e.kind == yaml.MappingNode && e.style&yaml.FlowStyle == 0 && len(e.value.Content) > 0 {
+				e.children = d.layoutEntries(e.value, e.contentEnd)
+			}
+		}
+	}
+	return d, nil
+}
+
+// layoutEntries records where each entry of a block mapping starts and ends
+// in the original text. limit is the line the mapping's own content ends at.
+func (d *composeDocument) layoutEntries(m *yaml.Node, limit int) []*docEntry {
+	var result []*docEntry
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		e := &docEntry{
+			key:     key,
+			value:   value,
+			keyLine: key.Line - 1,
+			kind:    value.Kind,
+			style:   value.Style,
+		}
+		e.headStart = e.keyLine
+		for e.headStart > 0 && isCommentLine(d.lines[e.headStart-1]) {
+			e.headStart--
+		}
+		result = append(result, e)
+		d.entries[key] = e
+	}
+	for i, e := range result {
+		next := limit
+		if i+1 < len(result) {
+			next = result[i+1].headStart
+		}
+		e.regionEnd = next
+		e.contentEnd = next
+		for e.contentEnd > e.keyLine+1 && isBlankOrComment(d.lines[e.contentEnd-1]) {
+			e.contentEnd--
+		}
+	}
+	return result
+}
+
+func isCommentLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "#")
+}
+
+func isBlankOrComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// detectIndent returns the indentation step used by the file, falling back to
+// the two spaces customMarshal writes.
+func detectIndent(top *yaml.Node) int {
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, value := top.Content[i], top.Content[i+1]
+		if value.Style&yaml.FlowStyle != 0 || len(value.Content) == 0 {
+			continue
+		}
+		if value.Kind == yaml.MappingNode || value.Kind == yaml.SequenceNode {
+			if step := value.Content[0].Column - key.Column; step > 0 {
+				return step
+			}
+		}
+	}
+	return 2
+}
+
+// top returns the top-level mapping of the document.
+func (d *composeDocument) top() *yaml.Node {
+	return d.doc.Content[0]
+}
+
+// touch marks the entry owned by the given top-level key (and optionally a
+// child key below it) as modified.
+func (d *composeDocument) touch(section string, name string) {
+	d.changed = true
+	sectionKey := mappingKey(d.top(), section)
+	if sectionKey == nil {
+		return
+	}
+	// Child entries can only be spliced individually when the section was a
+	// non-empty block mapping to begin with; otherwise re-encode the section.
+	if e, ok := d.entries[sectionKey]; ok && name != "" && len(e.children) > 0 {
+		// removed children need no marking, renderEntries skips them
+		if childKey := mappingKey(mappingValue(d.top(), section), name); childKey != nil {
+			d.dirty[childKey] = true
+		}
+		return
+	}
+	d.dirty[sectionKey] = true
+}
+
+// section returns the top-level mapping with the given name, or nil.
+func (d *composeDocument) section(name string) *yaml.Node {
+	m := mappingValue(d.top(), name)
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	return m
+}
+
+// ensureSection returns the top-level mapping with the given name, creating
+// it (or replacing an empty value such as `volumes:`) when needed.
+func (d *composeDocument) ensureSection(name string) *yaml.Node {
+	if m := d.section(name); m != nil {
+		if len(m.Content) == 0 {
+			// an empty `{}` would otherwise keep all new entries in flow style
+			m.Style &^= yaml.FlowStyle
+		}
+		return m
+	}
+	m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(d.top(), name, m)
+	d.touch(name, "")
+	return m
+}
+
+// service returns the node of a service defined in this file, or nil. A
+// service declared without a body (`web:`) is a null node; looking it up
+// leaves it that way.
+func (d *composeDocument) service(name string) *yaml.Node {
+	svc := mappingValue(d.section("services"), name)
+	if svc == nil {
+		return nil
+	}
+	if svc.Kind != yaml.MappingNode && !(svc.Kind == yaml.ScalarNode && svc.Tag == "!!null") {
+		return nil
+	}
+	return svc
+}
+
+// editableService returns the mapping of a service defined in this file, or
+// nil, turning a service declared without a body into an empty mapping that
+// keys can be written to.
+func (d *composeDocument) editableService(name string) *yaml.Node {
+	svc := d.service(name)
+	if svc == nil {
+		return nil
+	}
+	if svc.Kind == yaml.ScalarNode {
+		*svc = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	if len(svc.Content) == 0 {
+		svc.Style &^= yaml.FlowStyle
+	}
+	return svc
+}
+
+func (d *composeDocument) serviceNames() []string {
+	return mappingKeys(d.section("services"))
+}
+
+// save writes the document back to disk if anything was modified.
+func (d *composeDocument) save() error {
+	if !d.changed {
+		return nil
+	}
+	data, err := d.render()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.path, data, 0644)
+}
+
+// render rebuilds the file text: untouched entries are copied from the
+// original lines, touched and new entries are encoded with the file's indent.
+func (d *composeDocument) render() ([]byte, error) {
+	if len(d.order) == 0 {
+		return d.encodeNode(d.doc)
+	}
+
+	var out []string
+	out = append(out, d.lines[:d.preamble]...)
+
+	top := d.top()
+	rendered, err := d.renderEntries(top, d.order, 0)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, rendered...)
+	return []byte(strings.Join(out, "")), nil
+}
+
+// renderEntries renders the entries of mapping m, given the layout of the
+// entries it originally had. Entries are emitted in their current order;
+// original entries keep their head comments and trailers.
+func (d *composeDocument) renderEntries(m *yaml.Node, original []*docEntry, column int) ([]string, error) {
+	var out []string
+	separator := false
+	if len(original) > 1 {
+		for _, line := range d.lines[original[0].contentEnd:original[0].regionEnd] {
+			if strings.TrimSpace(line) == "" {
+				separator = true
+			}
+		}
+	}
+
+	emitted := 0
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		e, ok := d.entries[key]
+		if !ok {
+			text, err := d.encodeEntry(key, value, column, true)
+			if err != nil {
+				return nil, err
+			}
+			out = ensureNewline(out)
+			if separator && emitted > 0 && strings.TrimSpace(out[len(out)-1]) != "" {
+				out = append(out, "\n")
+			}
+			out = append(out, text...)
+			emitted++
+			continue
+		}
+
+		// Entries that were removed are skipped entirely, so the trailer of
+		// the previous entry keeps separating what is left.
+		out = append(out, d.lines[e.headStart:e.keyLine]...)
+		switch {
+		case d.dirty[key] || value != e.value || value.Kind != e.kind || value.Style != e.style:
+			text, err := d.encodeEntry(key, value, e.key.Column-1, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, text...)
+		case len(e.children) > 0:
+			header := e.children[0].headStart
+			out = append(out, d.lines[e.keyLine:header]...)
+			children, err := d.renderEntries(value, e.children, e.children[0].key.Column-1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, children...)
+		default:
+			out = append(out, d.lines[e.keyLine:e.contentEnd]...)
+		}
+		out = append(out, d.lines[e.contentEnd:e.regionEnd]...)
+		emitted++
+	}
+	return out, nil
+}
+
+// encodeEntry encodes a single key/value pair at the given column. For
+// entries that already existed the head comment is left to the original text.
+func (d *composeDocument) encodeEntry(key, value *yaml.Node, column int, isNew bool) ([]string, error) {
+	k := *key
+	if !isNew {
+		k.HeadComment = ""
+	}
+	k.FootComment = ""
+	m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{&k, value}}
+	data, err := d.encodeNode(m)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Repeat(" ", column)
+	var out []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			out = append(out, line)
+			continue
+		}
+		out = append(out, prefix+line)
+	}
+	return out, nil
+}
+
+func (d *composeDocument) encodeNode(n *yaml.Node) ([]byte, error) {
+	clearMergeTags(n)
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(d.indent)
+	if err := encoder.Encode(n); err != nil {
+		return nil, fmt.Errorf("error encoding %s: %v", d.path, err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding %s: %v", d.path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// clearMergeTags drops the explicit !!merge tag yaml.v3 puts on `<<` keys,
+// which it would otherwise print as `!!merge <<:`.
+func clearMergeTags(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Tag == "!!merge" {
+				n.Content[i].Tag = ""
+			}
+		}
+	}
+	for _, child := range n.Content {
+		clearMergeTags(child)
+	}
+}
+
+func ensureNewline(out []string) []string {
+	if n := len(out); n > 0 && !strings.HasSuffix(out[n-1], "\n") {
+		out[n-1] += "\n"
+	}
+	return out
+}
+
+// mappingKey returns the key node for key in mapping m, or nil.
+func mappingKey(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i]
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value node for key in mapping m, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func mappingKeys(m *yaml.Node) []string {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	var keys []string
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		keys = append(keys, m.Content[i].Value)
+	}
+	return keys
+}
+
+// setMappingValue replaces the value for key in mapping m, appending the key
+// when it does not exist yet.
+func setMappingValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, scalarNode(key), value)
+}
+
+// deleteMappingKey removes key from mapping m and reports whether it existed.
+func deleteMappingKey(m *yaml.Node, key string) bool {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ensureSequence returns the sequence stored under key in mapping m,
+// creating it when it does not exist or is empty.
+func ensureSequence(m *yaml.Node, key string) *yaml.Node {
+	if seq := mappingValue(m, key); seq != nil {
+		if seq.Kind == yaml.SequenceNode {
+			if len(seq.Content) == 0 {
+				seq.Style &^= yaml.FlowStyle
+			}
+			return seq
+		}
+		if seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+			*seq = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			return seq
+		}
+	}
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	setMappingValue(m, key, seq)
+	return seq
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func quotedNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, Style: yaml.DoubleQuotedStyle}
+}
+
+// resetNode returns a `!reset` value, which removes an inherited key.
+func resetNode() *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!reset", Value: "null"}
+}
+
+func boolNode(value bool) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: fmt.Sprintf("%t", value)}
+}
+
+// composeChain is a compose file loaded together with the files it extends,
+// ordered by precedence: the file named by -f first, then its parents from
+// the one merged last to the one merged first.
+// Mutation commands use it to find the file that owns a service or key
+// instead of flattening the extend chain into the child.
+type composeChain struct {
+	docs []*composeDocument
+}
+
+func loadComposeChain(path string) (*composeChain, error) {
+	var order []*composeDocument
+	loaded := make(map[string]bool)
+	if err := loadComposeChainRecursive(path, nil, loaded, &order); err != nil {
+		return nil, err
+	}
+	chain := &composeChain{}
+	for i := len(order) - 1; i >= 0; i-- {
+		chain.docs = append(chain.docs, order[i])
+	}
+	return chain, nil
+}
+
+// loadComposeChainRecursive loads the extend graph in the same order as
+// readAndMergeConfigsRecursive, so docs can be reversed into precedence order.
+func loadComposeChainRecursive(path string, visited []string, loaded map[string]bool, order *[]*composeDocument) error {
+	path = filepath.Clean(path)
+	for i, file := range visited {
+		if file == path {
+			chain := append(append([]string{}, visited[i:]...), path)
+			return fmt.Errorf("circular dependency detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if loaded[path] {
+		return nil
+	}
+	doc, err := loadComposeDocument(path)
+	if err != nil {
+		return err
+	}
+
+	var extend extendList
+	if node := mappingValue(doc.top(), "extend"); node != nil {
+		if err := node.Decode(&extend); err != nil {
+			return fmt.Errorf("error parsing xdocker file %s: %v", path, err)
+		}
+	}
+	visited = append(visited[:len(visited):len(visited)], path)
+	for _, parent := range extend {
+		if err := loadComposeChainRecursive(filepath.Join(filepath.Dir(path), parent), visited, loaded, order); err != nil {
+			return err
+		}
+	}
+
+	loaded[path] = true
+	*order = append(*order, doc)
+	return nil
+}
+
+// file returns the document named by -f.
+func (c *composeChain) file() *composeDocument {
+	return c.docs[0]
+}
+
+// serviceOwner returns the nearest file that defines the service, or nil.
+func (c *composeChain) serviceOwner(service string) *composeDocument {
+	for _, doc := range c.docs {
+		if doc.service(service) != nil {
+			return doc
+		}
+	}
+	return nil
+}
+
+// keyOwner returns the nearest file whose definition of the service sets
+// key, which is the definition that wins after merging.
+func (c *composeChain) keyOwner(service, key string) *composeDocument {
+	for _, doc := range c.docs {
+		if mappingKey(doc.service(service), key) != nil {
+			return doc
+		}
+	}
+	return nil
+}
+
+// serviceNames returns the services of the merged configuration, in the
+// order they first appear along the chain.
+func (c *composeChain) serviceNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, doc := range c.docs {
+		for _, name := range doc.serviceNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// editService returns the file and service mapping an edit should go to.
+// With inParent that is the nearest extended file defining the service;
+// otherwise it is the -f file, where an inherited service gets a minimal
+// override entry.
+func (c *composeChain) editService(service string, inParent bool) (*composeDocument, *yaml.Node, error) {
+	if c.serviceOwner(service) == nil {
+		return nil, nil, fmt.Errorf("service %s not found", service)
+	}
+	if inParent {
+		for _, doc := range c.docs[1:] {
+			if svc := doc.editableService(service); svc != nil {
+				return doc, svc, nil
+			}
+		}
+	}
+	doc := c.file()
+	if svc := doc.editableService(service); svc != nil {
+		return doc, svc, nil
+	}
+	svc := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(doc.ensureSection("services"), service, svc)
+	doc.touch("services", service)
+	return doc, svc, nil
+}
+
+// editSequence returns the file and the sequence under key (ports, volumes)
+// new items for the service should be added to. Lists are concatenated
+// along the extend chain, so an override in the -f file only needs to
+// declare the new items.
+func (c *composeChain) editSequence(service, key string, inParent bool) (*composeDocument, *yaml.Node, error) {
+	if inParent {
+		for _, doc := range c.docs[1:] {
+			if mappingKey(doc.service(service), key) != nil {
+				return doc, ensureSequence(doc.service(service), key), nil
+			}
+		}
+	}
+	doc, svc, err := c.editService(service, inParent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, ensureSequence(svc, key), nil
+}
+
+// editSequenceItems applies edit to the items of the service's sequence
+// under key. With inParent every file declaring a matching item is edited.
+// Otherwise inherited items can only be changed by replacing the merged
+// list in the -f file with a `!override` copy that edit is applied to.
+func (c *composeChain) editSequenceItems(service, key, prefix string, inParent bool, edit func(*yaml.Node) bool) error {
+	if inParent {
+		for _, doc := range c.docs {
+			if edit(mappingValue(doc.service(service), key)) {
+				doc.touch("services", service)
+			}
+		}
+		return nil
+	}
+
+	doc := c.file()
+	own := mappingValue(doc.service(service), key)
+	inherited := sequenceHasPrefix(c.mergedSequence(service, key, c.docs[1:]), prefix)
+	if !inherited || own != nil && own.Tag == "!override" {
+		if edit(own) {
+			doc.touch("services", service)
+		}
+		return nil
+	}
+
+	override := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!override"}
+	for _, item := range c.mergedSequence(service, key, c.docs).Content {
+		override.Content = append(override.Content, copyNode(item))
+	}
+	_, svc, err := c.editService(service, false)
+	if err != nil {
+		return err
+	}
+	setMappingValue(svc, key, override)
+	edit(override)
+	doc.touch("services", service)
+	return nil
+}
+
+// mergedSequence approximates the merged value of the service's sequence
+// under key across docs: items are concatenated from the farthest parent to
+// the nearest file and de-duplicated, honouring `!override` and `!reset`.
+func (c *composeChain) mergedSequence(service, key string, docs []*composeDocument) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for i := len(docs) - 1; i >= 0; i-- {
+		seq := mappingValue(docs[i].service(service), key)
+		if seq == nil {
+			continue
+		}
+		if seq.Tag == "!override" || seq.Tag == "!reset" {
+			merged.Content = nil
+		}
+		if seq.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, item := range seq.Content {
+			duplicate := false
+			for j, existing := range merged.Content {
+				if existing.Kind == yaml.ScalarNode && item.Kind == yaml.ScalarNode && existing.Value == item.Value {
+					merged.Content[j] = item
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				merged.Content = append(merged.Content, item)
+			}
+		}
+	}
+	return merged
+}
+
+// pruneOverride removes the service entry from the -f file when it no longer
+// overrides anything of a service defined in an extended file.
+func (c *composeChain) pruneOverride(service string) {
+	doc := c.file()
+	svc := doc.service(service)
+	if svc == nil || len(svc.Content) > 0 {
+		return
+	}
+	for _, parent := range c.docs[1:] {
+		if parent.service(service) != nil {
+			deleteMappingKey(doc.section("services"), service)
+			doc.touch("services", service)
+			return
+		}
+	}
+}
+
+// save writes every file of the chain that was modified.
+func (c *composeChain) save() error {
+	for _, doc := range c.docs {
+		if err := doc.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyNode returns a deep copy of n.
+func copyNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = copyNode(child)
+	}
+	return &c
+}
+
+// sequenceHas reports whether the merged value of the service's sequence
+// under key contains a "<prefix>:..." item.
+func (c *composeChain) sequenceHas(service, key, prefix string) bool {
+	return sequenceHasPrefix(c.mergedSequence(service, key, c.docs), prefix)
+}
+
+func sequenceHasPrefix(seq *yaml.Node, prefix string) bool {
+	for _, item := range seq.Content {
+		if item.Kind == yaml.ScalarNode && strings.HasPrefix(item.Value, prefix+":") {
+			return true
+		}
+	}
+	return false
+}
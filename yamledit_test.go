@@ -0,0 +1,354 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const renderInput = `# project services
+version: "3"
+
+services:
+  # the web frontend
+  web:
+    image: nginx   # pinned later
+    ports:
+      - "80:80"
+
+  db:
+    image: postgres
+
+volumes:
+  data: {}
+`
+
+func TestComposeDocumentRender(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		edit  func(d *composeDocument)
+		want  string
+	}{
+		{
+			name:  "untouched document is unchanged",
+			input: renderInput,
+			edit:  func(d *composeDocument) {},
+			want:  renderInput,
+		},
+		{
+			name:  "only the touched service is re-encoded",
+			input: renderInput,
+			edit: func(d *composeDocument) {
+				setMappingValue(d.editableService("db"), "skip", boolNode(true))
+				d.touch("services", "db")
+			},
+			want: `# project services
+version: "3"
+
+services:
+  # the web frontend
+  web:
+    image: nginx   # pinned later
+    ports:
+      - "80:80"
+
+  db:
+    image: postgres
+    skip: true
+
+volumes:
+  data: {}
+`,
+		},
+		{
+			name:  "new service is separated like the others",
+			input: renderInput,
+			edit: func(d *composeDocument) {
+				svc := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				setMappingValue(svc, "image", scalarNode("redis"))
+				setMappingValue(d.ensureSection("services"), "cache", svc)
+				d.touch("services", "cache")
+			},
+			want: `# project services
+version: "3"
+
+services:
+  # the web frontend
+  web:
+    image: nginx   # pinned later
+    ports:
+      - "80:80"
+
+  db:
+    image: postgres
+
+  cache:
+    image: redis
+
+volumes:
+  data: {}
+`,
+		},
+		{
+			name:  "removed service leaves its neighbours alone",
+			input: renderInput,
+			edit: func(d *composeDocument) {
+				deleteMappingKey(d.section("services"), "web")
+				d.touch("services", "web")
+			},
+			want: `# project services
+version: "3"
+
+services:
+  db:
+    image: postgres
+
+volumes:
+  data: {}
+`,
+		},
+		{
+			name:  "new section is added at the end",
+			input: "services:\n  web:\n    image: nginx\n",
+			edit: func(d *composeDocument) {
+				setMappingValue(d.ensureSection("networks"), "front", resetNode())
+			},
+			want: "services:\n  web:\n    image: nginx\nnetworks:\n  front: !reset null\n",
+		},
+		{
+			name:  "indentation of the file is kept",
+			input: "services:\n    web:\n        image: nginx\n",
+			edit: func(d *composeDocument) {
+				ensureSequence(d.editableService("web"), "ports").Content = []*yaml.Node{quotedNode("80:80")}
+				d.touch("services", "web")
+			},
+			want: "services:\n    web:\n        image: nginx\n        ports:\n            - \"80:80\"\n",
+		},
+		{
+			name:  "service without a body survives lookups",
+			input: "services:\n  web:\n    image: nginx\n  cache:\n",
+			edit: func(d *composeDocument) {
+				if d.service("cache") == nil || mappingKey(d.service("cache"), "image") != nil {
+					t.Error("service(\"cache\") does not find the service without a body")
+				}
+				setMappingValue(d.editableService("web"), "skip", boolNode(true))
+				d.touch("services", "web")
+				d.touch("services", "cache")
+			},
+			want: "services:\n  web:\n    image: nginx\n    skip: true\n  cache:\n",
+		},
+		{
+			name:  "service without a body gets one when edited",
+			input: "services:\n  web:\n",
+			edit: func(d *composeDocument) {
+				setMappingValue(d.editableService("web"), "image", scalarNode("nginx"))
+				d.touch("services", "web")
+			},
+			want: "services:\n  web:\n    image: nginx\n",
+		},
+		{
+			name:  "empty document is encoded from scratch",
+			input: "",
+			edit: func(d *composeDocument) {
+				setMappingValue(d.ensureSection("services"), "web", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+			},
+			want: "services:\n  web: {}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "xdocker-compose.yml")
+			if err := os.WriteFile(path, []byte(test.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			d, err := loadComposeDocument(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.edit(d)
+			got, err := d.render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("render() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+const chainParent = `services:
+  web:
+    image: nginx
+    ports:
+      - "80:80"
+      - "443:443"
+`
+
+func TestComposeChainEdits(t *testing.T) {
+	addPort := func(inParent bool) func(c *composeChain) error {
+		return func(c *composeChain) error {
+			doc, ports, err := c.editSequence("web", "ports", inParent)
+			if err != nil {
+				return err
+			}
+			ports.Content = append(ports.Content, quotedNode("8080:80"))
+			doc.touch("services", "web")
+			return nil
+		}
+	}
+	removePort := func(inParent bool) func(c *composeChain) error {
+		return func(c *composeChain) error {
+			return c.editSequenceItems("web", "ports", "443", inParent, func(seq *yaml.Node) bool {
+				return removeSequenceItems(seq, "443")
+			})
+		}
+	}
+
+	tests := []struct {
+		name       string
+		child      string
+		edit       func(c *composeChain) error
+		wantChild  string
+		wantParent string
+		// err is a part of the expected error, if any
+		err string
+	}{
+		{
+			name:  "inherited service gets an override entry",
+			child: "extend: parent.yml\n",
+			edit: func(c *composeChain) error {
+				doc, svc, err := c.editService("web", false)
+				if err == nil {
+					setMappingValue(svc, "skip", boolNode(true))
+					doc.touch("services", "web")
+				}
+				return err
+			},
+			wantChild: "extend: parent.yml\nservices:\n  web:\n    skip: true\n",
+		},
+		{
+			name:  "edit in the parent",
+			child: "extend: parent.yml\n",
+			edit: func(c *composeChain) error {
+				doc, svc, err := c.editService("web", true)
+				if err == nil {
+					setMappingValue(svc, "skip", boolNode(true))
+					doc.touch("services", "web")
+				}
+				return err
+			},
+			wantParent: chainParent + "    skip: true\n",
+		},
+		{
+			name:  "unknown service",
+			child: "extend: parent.yml\n",
+			edit: func(c *composeChain) error {
+				_, _, err := c.editService("db", false)
+				return err
+			},
+			err: "service db not found",
+		},
+		{
+			name:      "new list items go to the -f file",
+			child:     "extend: parent.yml\n",
+			edit:      addPort(false),
+			wantChild: "extend: parent.yml\nservices:\n  web:\n    ports:\n      - \"8080:80\"\n",
+		},
+		{
+			name:       "new list items go to the parent that declares the list",
+			child:      "extend: parent.yml\nservices:\n  web:\n    image: nginx:1.27\n",
+			edit:       addPort(true),
+			wantParent: strings.Replace(chainParent, "      - \"443:443\"\n", "      - \"443:443\"\n      - \"8080:80\"\n", 1),
+		},
+		{
+			name:      "inherited items are removed through an override copy",
+			child:     "extend: parent.yml\n",
+			edit:      removePort(false),
+			wantChild: "extend: parent.yml\nservices:\n  web:\n    ports: !override\n      - \"80:80\"\n",
+		},
+		{
+			name:      "an existing override copy is edited in place",
+			child:     "extend: parent.yml\nservices:\n  web:\n    ports: !override\n      - \"443:443\"\n      - \"9090:90\"\n",
+			edit:      removePort(false),
+			wantChild: "extend: parent.yml\nservices:\n  web:\n    ports: !override\n      - \"9090:90\"\n",
+		},
+		{
+			name:       "inherited items are removed in the parent",
+			child:      "extend: parent.yml\n",
+			edit:       removePort(true),
+			wantParent: strings.Replace(chainParent, "      - \"443:443\"\n", "", 1),
+		},
+		{
+			name:  "empty override entry is pruned",
+			child: "extend: parent.yml\nservices:\n  web:\n    skip: true\n",
+			edit: func(c *composeChain) error {
+				deleteMappingKey(c.file().service("web"), "skip")
+				c.file().touch("services", "web")
+				c.pruneOverride("web")
+				return nil
+			},
+			wantChild: "extend: parent.yml\nservices:\n",
+		},
+		{
+			name:  "service of the -f file is not pruned",
+			child: "extend: parent.yml\nservices:\n  db:\n    skip: true\n",
+			edit: func(c *composeChain) error {
+				deleteMappingKey(c.file().service("db"), "skip")
+				c.file().touch("services", "db")
+				c.pruneOverride("db")
+				return nil
+			},
+			wantChild: "extend: parent.yml\nservices:\n  db: {}\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			parentPath, childPath := filepath.Join(dir, "parent.yml"), filepath.Join(dir, "xdocker-compose.yml")
+			if err := os.WriteFile(parentPath, []byte(chainParent), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(childPath, []byte(test.child), 0644); err != nil {
+				t.Fatal(err)
+			}
+			chain, err := loadComposeChain(childPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = test.edit(chain)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := chain.save(); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range []struct{ path, want, unchanged string }{
+				{childPath, test.wantChild, test.child},
+				{parentPath, test.wantParent, chainParent},
+			} {
+				want := file.want
+				if want == "" {
+					want = file.unchanged
+				}
+				got, err := os.ReadFile(file.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s =\n%s\nwant\n%s", filepath.Base(file.path), got, want)
+				}
+			}
+		})
+	}
+}